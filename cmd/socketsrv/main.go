@@ -11,10 +11,13 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/quic-go/webtransport-go"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/woogles-io/liwords-socket/pkg/config"
 	sockets "github.com/woogles-io/liwords-socket/pkg/hub"
+	"github.com/woogles-io/liwords-socket/pkg/redact"
+	"github.com/woogles-io/liwords-socket/pkg/tracing"
 )
 
 const (
@@ -38,7 +41,13 @@ func main() {
 
 	cfg := &config.Config{}
 	cfg.Load(os.Args[1:])
-	log.Info().Interface("config", cfg).
+
+	out, err := redact.NewWriter(os.Stderr, cfg.LogPII, cfg.LogPIIKey)
+	if err != nil {
+		panic(err)
+	}
+	log.Logger = log.Output(out)
+	log.Info().Interface("config", cfg.Redacted()).
 		Str("build-date", BuildDate).Str("build-hash", BuildHash).Msg("started")
 
 	if cfg.Debug {
@@ -49,6 +58,11 @@ func main() {
 
 	log.Debug().Msg("debug log is on")
 
+	shutdownTracing, err := tracing.Setup(cfg, BuildHash)
+	if err != nil {
+		panic(err)
+	}
+
 	h, err := sockets.NewHub(cfg)
 	if err != nil {
 		panic(err)
@@ -62,11 +76,25 @@ func main() {
 	router := http.NewServeMux() // here you could also go with third party packages to create a router
 
 	router.Handle("/ping", http.HandlerFunc(pingEndpoint))
+	router.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sockets.ServeHealthz(h, w, r)
+	}))
+	router.Handle("/readyz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sockets.ServeReadyz(h, w, r)
+	}))
 
 	router.Handle("/ws", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sockets.ServeWS(h, w, r)
 	}))
 
+	// Fallback transport for networks that block websockets.
+	router.Handle("/sse", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sockets.ServeSSE(h, w, r)
+	}))
+	router.Handle("/sse/send", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sockets.ServeSSESend(h, w, r)
+	}))
+
 	router.Handle("/debug/vars", http.DefaultServeMux)
 
 	srv := &http.Server{
@@ -75,6 +103,39 @@ func main() {
 		WriteTimeout: 10 * time.Second,
 		ReadTimeout:  10 * time.Second}
 
+	var adminSrv *http.Server
+	if cfg.AdminAddress != "" {
+		if cfg.AdminToken == "" {
+			log.Fatal().Msg("admin-token is required when admin-address is set")
+		}
+		adminSrv = &http.Server{
+			Addr:         cfg.AdminAddress,
+			Handler:      sockets.NewAdminHandler(h, cfg.AdminToken),
+			WriteTimeout: 10 * time.Second,
+			ReadTimeout:  10 * time.Second}
+		go func() {
+			log.Info().Str("address", cfg.AdminAddress).Msg("starting admin listener...")
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error().Err(err).Msg("admin-server")
+			}
+		}()
+	}
+
+	var wt *webtransport.Server
+	if cfg.WebTransportAddress != "" {
+		cert, err := webTransportCert(cfg)
+		if err != nil {
+			panic(err)
+		}
+		wt = sockets.NewWebTransportServer(h, cfg.WebTransportAddress, cert)
+		go func() {
+			log.Info().Str("address", cfg.WebTransportAddress).Msg("starting webtransport listener...")
+			if err := wt.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error().Err(err).Msg("webtransport-server")
+			}
+		}()
+	}
+
 	idleConnsClosed := make(chan struct{})
 	sig := make(chan os.Signal, 1)
 
@@ -82,12 +143,27 @@ func main() {
 		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 		<-sig
 		log.Info().Msg("got quit signal...")
+		h.Drain()
+		// Give the load balancer time to see /readyz fail, so it stops
+		// sending new connections here before we stop accepting them.
+		// Another signal cuts the wait short.
+		log.Info().Dur("delay", cfg.DrainDelay).Msg("draining")
+		select {
+		case <-time.After(cfg.DrainDelay):
+		case <-sig:
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), GracefulShutdownTimeout)
 		if err := srv.Shutdown(ctx); err != nil {
 			// Error from closing listeners, or context timeout:
 			log.Error().Msgf("HTTP server Shutdown: %v", err)
 		}
+		if adminSrv != nil {
+			adminSrv.Shutdown(ctx)
+		}
 		cancel()
+		if wt != nil {
+			wt.Close()
+		}
 		close(idleConnsClosed)
 	}()
 
@@ -97,5 +173,13 @@ func main() {
 		log.Fatal().Err(err).Msg("")
 	}
 	<-idleConnsClosed
+	if err := h.Close(); err != nil {
+		log.Err(err).Msg("closing-audit-log")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GracefulShutdownTimeout)
+	if err := shutdownTracing(ctx); err != nil {
+		log.Err(err).Msg("shutting-down-tracing")
+	}
+	cancel()
 	log.Info().Msg("server gracefully shutting down")
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/woogles-io/liwords-socket/pkg/config"
+)
+
+// Browsers only accept a self-signed certificate through
+// serverCertificateHashes if it is ECDSA and valid for at most two weeks.
+const selfSignedValidity = 14 * 24 * time.Hour
+
+// selfSignedCert generates a throwaway certificate for local testing of the
+// WebTransport endpoint.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(selfSignedValidity - time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	hash := sha256.Sum256(der)
+	log.Warn().Str("sha256", base64.StdEncoding.EncodeToString(hash[:])).
+		Msg("using a self-signed webtransport certificate; pass this hash as serverCertificateHashes")
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// webTransportCert returns the configured WebTransport certificate, or a
+// self-signed one if none is configured.
+func webTransportCert(cfg *config.Config) (tls.Certificate, error) {
+	if cfg.WebTransportCertFile != "" {
+		return tls.LoadX509KeyPair(cfg.WebTransportCertFile, cfg.WebTransportKeyFile)
+	}
+	return selfSignedCert()
+}
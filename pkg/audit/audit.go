@@ -0,0 +1,155 @@
+// Package audit keeps an append-only record of connection lifecycle events,
+// for moderation. Events can go to a NATS subject, to rotated local JSONL
+// files, or both.
+package audit
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Event types.
+const (
+	Connect    = "connect"
+	LoginFail  = "login-fail"
+	RealmJoin  = "realm-join"
+	Kick       = "kick"
+	Ban        = "ban"
+	Disconnect = "disconnect"
+)
+
+// queueSize is how many events may be waiting to be written before we start
+// dropping them. Audit logging must never hold up the hub.
+const queueSize = 4096
+
+var dropped = expvar.NewInt("audit-events-dropped")
+
+// An Event is a single audit record.
+type Event struct {
+	Time          time.Time `json:"time"`
+	Type          string    `json:"type"`
+	ConnID        string    `json:"connID,omitempty"`
+	UserID        string    `json:"userID,omitempty"`
+	Username      string    `json:"username,omitempty"`
+	Authenticated bool      `json:"authenticated"`
+	IP            string    `json:"ip,omitempty"`
+	Transport     string    `json:"transport,omitempty"`
+	Realms        []string  `json:"realms,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	DurationMs    int64     `json:"durationMs,omitempty"`
+}
+
+// A Publisher publishes to NATS. *nats.Conn is one.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// Options configure a Logger. Each sink is off if left empty.
+type Options struct {
+	// Events are published to Subject + "." + the event type.
+	Subject   string
+	Publisher Publisher
+	// Files are written to Dir; see fileSink.
+	Dir           string
+	MaxFileBytes  int64
+	RetentionDays int
+}
+
+// Logger writes audit events to its sinks. A nil *Logger discards events.
+type Logger struct {
+	opts   Options
+	events chan Event
+	files  *fileSink
+	done   chan struct{}
+
+	// mu guards closed, so that a late Log after Close doesn't panic.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New returns a Logger, or nil if no sinks are configured.
+func New(opts Options) (*Logger, error) {
+	if opts.Subject == "" && opts.Dir == "" {
+		return nil, nil
+	}
+	l := &Logger{
+		opts:   opts,
+		events: make(chan Event, queueSize),
+		done:   make(chan struct{}),
+	}
+	if opts.Dir != "" {
+		files, err := newFileSink(opts.Dir, opts.MaxFileBytes, opts.RetentionDays)
+		if err != nil {
+			return nil, err
+		}
+		l.files = files
+	}
+	go l.run()
+	return l, nil
+}
+
+// Log queues an event. It never blocks; if the queue is full the event is
+// dropped and counted.
+func (l *Logger) Log(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.events <- e:
+	default:
+		dropped.Add(1)
+	}
+}
+
+// Close writes out any queued events and closes the files.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.events)
+	l.mu.Unlock()
+	<-l.done
+	if l.files != nil {
+		return l.files.close()
+	}
+	return nil
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	for e := range l.events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Err(err).Msg("audit-marshal")
+			continue
+		}
+		if l.opts.Subject != "" && l.opts.Publisher != nil {
+			if err := l.opts.Publisher.Publish(l.opts.Subject+"."+e.Type, data); err != nil {
+				log.Err(err).Msg("audit-publish")
+			}
+		}
+		if l.files != nil {
+			if err := l.files.write(e.Time, data); err != nil {
+				log.Err(err).Msg("audit-write")
+			}
+		}
+	}
+}
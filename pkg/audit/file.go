@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const filePrefix = "audit-"
+
+// fileSink writes events as JSON lines to files named
+// audit-YYYY-MM-DD.N.jsonl in its directory. It starts a new file every UTC
+// day, and whenever the current one grows past maxBytes. Files older than
+// the retention period are deleted each time it rotates.
+type fileSink struct {
+	dir           string
+	maxBytes      int64
+	retentionDays int
+
+	f    *os.File
+	day  string
+	seq  int
+	size int64
+}
+
+func newFileSink(dir string, maxBytes int64, retentionDays int) (*fileSink, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &fileSink{dir: dir, maxBytes: maxBytes, retentionDays: retentionDays}, nil
+}
+
+func (s *fileSink) write(t time.Time, line []byte) error {
+	day := t.UTC().Format("2006-01-02")
+	if s.f == nil || day != s.day || (s.maxBytes > 0 && s.size+int64(len(line))+1 > s.maxBytes) {
+		if err := s.rotate(day); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(append(line, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) rotate(day string) error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	if day != s.day {
+		s.day = day
+		s.seq = 0
+	} else {
+		s.seq++
+	}
+	// Don't clobber files from before a restart.
+	for {
+		name := filepath.Join(s.dir, fmt.Sprintf("%s%s.%d.jsonl", filePrefix, s.day, s.seq))
+		fi, err := os.Stat(name)
+		if err == nil && s.maxBytes > 0 && fi.Size() >= s.maxBytes {
+			s.seq++
+			continue
+		}
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		s.f = f
+		s.size = 0
+		if fi != nil {
+			s.size = fi.Size()
+		}
+		break
+	}
+	s.prune()
+	return nil
+}
+
+// prune deletes files older than the retention period.
+func (s *fileSink) prune() {
+	if s.retentionDays <= 0 {
+		return
+	}
+	cutoff := time.Now().UTC().AddDate(0, 0, -s.retentionDays).Format("2006-01-02")
+	names, err := filepath.Glob(filepath.Join(s.dir, filePrefix+"*.jsonl"))
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		day, _, ok := strings.Cut(strings.TrimPrefix(filepath.Base(name), filePrefix), ".")
+		if !ok || day >= cutoff {
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			log.Err(err).Str("file", name).Msg("audit-prune")
+		}
+	}
+}
+
+func (s *fileSink) close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
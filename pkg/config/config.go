@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/namsral/flag"
 )
 
@@ -8,7 +10,98 @@ type Config struct {
 	Debug            bool
 	WebsocketAddress string
 	NatsURL          string
-	SecretKey        string
+	SecretKey        string `secret:"true"`
+	// AllowJSONProtocol lets any client use the JSON debugging protocol.
+	// Admins can always use it. Keep this off in production.
+	AllowJSONProtocol bool
+	// WebsocketCompression turns on permessage-deflate for clients that
+	// offer it.
+	WebsocketCompression bool
+
+	// NATS reconnection; a NatsMaxReconnects of -1 retries forever.
+	NatsReconnectWait  time.Duration
+	NatsMaxReconnects  int
+	NatsReconnectBufMB int
+
+	// NATS TLS and authentication. Startup fails if NATS won't let us
+	// subscribe where we need to. NatsCheckPublish checks publishing too;
+	// it is off by default since it publishes empty probe messages to the
+	// subjects everyone else listens on.
+	NatsCAFile       string
+	NatsCertFile     string
+	NatsKeyFile      string
+	NatsCredsFile    string
+	NatsNkeySeedFile string
+	NatsToken        string `secret:"true"`
+	NatsCheckPublish bool
+	// NatsSubjectPrefix namespaces every subject, so that several
+	// environments can share a NATS cluster.
+	NatsSubjectPrefix string
+
+	// TrustedProxies is a comma-separated list of CIDRs whose forwarding
+	// headers we believe. ClientIPHeader is the one header they set:
+	// x-forwarded-for, forwarded or x-real-ip.
+	TrustedProxies string
+	ClientIPHeader string
+
+	// Caps on concurrent connections; 0 means no cap. Authenticated users
+	// are capped by user ID and anonymous ones by IP.
+	MaxConns          int
+	MaxConnsPerUser   int
+	MaxConnsPerAnonIP int
+
+	// Realm registration; see the hub's realms.go.
+	RealmTimeout time.Duration
+	RealmRetries int
+	// RealmCacheTTL is how long registerRealm responses are cached; 0 turns
+	// the cache off.
+	RealmCacheTTL time.Duration
+
+	// See the hub's auth.go. AllowTokenQueryParam is deprecated and will
+	// go away once front ends have moved off it.
+	AuthTimeout          time.Duration
+	AllowTokenQueryParam bool
+
+	// TrustClientConnIDs takes connection IDs from the cid query parameter
+	// as is for liwords.v1 clients, which are never told the ID we pick.
+	// It is for migrating: turn it on while front ends still rely on
+	// their own cid, and off once they speak liwords.v2. liwords.v2
+	// clients always get an ID we pick. See the hub's connid.go.
+	TrustClientConnIDs bool
+
+	// DrainDelay is how long we keep serving after being told to stop,
+	// with /readyz failing, so that load balancers take the node out of
+	// rotation before its listener closes.
+	DrainDelay time.Duration
+
+	// BanFile holds the ban list; see the hub's bans.go.
+	BanFile string
+
+	// Tracing; see the tracing package for the exporters.
+	OTelExporter    string
+	OTelFile        string
+	OTelEndpoint    string
+	OTelSampleRatio float64
+
+	// The admin API is off unless an address is given.
+	AdminAddress string
+	AdminToken   string `secret:"true"`
+
+	// WebTransport is experimental, and off unless an address is given.
+	WebTransportAddress  string
+	WebTransportCertFile string
+	WebTransportKeyFile  string
+
+	// The audit log is off unless a subject or directory is given.
+	AuditSubject       string
+	AuditDir           string
+	AuditMaxFileMB     int
+	AuditRetentionDays int
+
+	// LogPII is what to do with usernames and IPs in the logs: keep, hash
+	// or drop. See the redact package.
+	LogPII    string
+	LogPIIKey string `secret:"true"`
 }
 
 // Load loads the configs from the given arguments
@@ -18,7 +111,50 @@ func (c *Config) Load(args []string) error {
 	fs.StringVar(&c.WebsocketAddress, "ws-address", ":8087", "WS server listens on this address")
 	fs.BoolVar(&c.Debug, "debug", false, "debug logging on")
 	fs.StringVar(&c.NatsURL, "nats-url", "nats://localhost:4222", "the NATS server URL")
+	fs.DurationVar(&c.NatsReconnectWait, "nats-reconnect-wait", 2*time.Second, "how long to wait between attempts to reconnect to NATS")
+	fs.IntVar(&c.NatsMaxReconnects, "nats-max-reconnects", -1, "how many times to try reconnecting to NATS before giving up; -1 for no limit")
+	fs.IntVar(&c.NatsReconnectBufMB, "nats-reconnect-buffer-mb", 8, "how much to buffer for publishing while NATS is reconnecting")
+	fs.StringVar(&c.NatsCAFile, "nats-ca-file", "", "CA certificate to verify the NATS server with")
+	fs.StringVar(&c.NatsCertFile, "nats-cert-file", "", "client certificate for NATS TLS")
+	fs.StringVar(&c.NatsKeyFile, "nats-key-file", "", "client key for NATS TLS")
+	fs.StringVar(&c.NatsCredsFile, "nats-creds-file", "", "NATS user credentials file")
+	fs.StringVar(&c.NatsNkeySeedFile, "nats-nkey-seed-file", "", "file holding the NATS nkey seed to authenticate with")
+	fs.StringVar(&c.NatsToken, "nats-token", "", "NATS authentication token")
+	fs.BoolVar(&c.NatsCheckPublish, "nats-check-publish-permissions", false, "also check at startup that NATS lets us publish to the subjects we need; publishes empty permissionCheck messages to ipc.*, broadcast and the audit subject")
+	fs.StringVar(&c.NatsSubjectPrefix, "nats-subject-prefix", "", "prefix for every NATS subject, e.g. staging; the API must use the same one")
 	fs.StringVar(&c.SecretKey, "secret-key", "", "secret key must be a random unguessable string")
+	fs.BoolVar(&c.AllowJSONProtocol, "allow-json-protocol", false, "allow any client to connect with ?format=json; not for production")
+	fs.BoolVar(&c.WebsocketCompression, "ws-compression", false, "negotiate permessage-deflate with websocket clients")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7", "comma-separated CIDRs of proxies whose client IP header is trusted")
+	fs.StringVar(&c.ClientIPHeader, "client-ip-header", "x-forwarded-for", "the header our proxies put the client's IP in: x-forwarded-for, forwarded or x-real-ip; no other is read")
+	fs.IntVar(&c.MaxConns, "max-conns", 0, "maximum concurrent connections on this node; 0 for no limit")
+	fs.IntVar(&c.MaxConnsPerUser, "max-conns-per-user", 20, "maximum concurrent connections per authenticated user; 0 for no limit")
+	fs.IntVar(&c.MaxConnsPerAnonIP, "max-conns-per-anon-ip", 50, "maximum concurrent anonymous connections per IP; 0 for no limit")
+	fs.DurationVar(&c.RealmTimeout, "realm-timeout", 5*time.Second, "how long to wait for the API to register a connection's realms")
+	fs.IntVar(&c.RealmRetries, "realm-retries", 3, "how many times to retry realm registration before degrading the connection")
+	fs.DurationVar(&c.RealmCacheTTL, "realm-cache-ttl", 10*time.Second, "how long to cache the realms for a path and user; 0 to turn off")
+	fs.DurationVar(&c.AuthTimeout, "auth-timeout", 5*time.Second, "how long a websocket client has to send its auth message after connecting")
+	fs.BoolVar(&c.AllowTokenQueryParam, "allow-token-query-param", true, "accept the auth token in the token query parameter; deprecated")
+	fs.BoolVar(&c.TrustClientConnIDs, "trust-client-conn-ids", false, "while migrating front ends to liwords.v2, use a liwords.v1 client's cid as its connection ID when the token doesn't bind one; insecure, and deprecated")
+	fs.DurationVar(&c.DrainDelay, "drain-delay", 10*time.Second, "how long to keep serving with /readyz failing after SIGTERM, before shutting down; set to at least the load balancer's readiness period")
+	fs.StringVar(&c.BanFile, "ban-file", "", "JSON file to load the ban list from and save updates to")
+	fs.StringVar(&c.OTelExporter, "otel-exporter", "none", "trace exporter: none, stdout, file or otlp")
+	fs.StringVar(&c.OTelFile, "otel-file", "traces.jsonl", "file to write traces to with the file exporter")
+	fs.StringVar(&c.OTelEndpoint, "otel-endpoint", "", "OTLP/HTTP endpoint URL for the otlp exporter; defaults to the OTEL_EXPORTER_OTLP_* env vars")
+	fs.Float64Var(&c.OTelSampleRatio, "otel-sample-ratio", 1, "fraction of new traces to sample")
+	fs.StringVar(&c.AdminAddress, "admin-address", "", "admin API listens on this address; off if empty")
+	fs.StringVar(&c.AdminToken, "admin-token", "", "bearer token required by the admin API")
+	fs.StringVar(&c.WebTransportAddress, "webtransport-address", "", "experimental WebTransport server listens on this UDP address; off if empty")
+	fs.StringVar(&c.WebTransportCertFile, "webtransport-cert-file", "", "TLS certificate for WebTransport; a self-signed one is generated if empty")
+	fs.StringVar(&c.WebTransportKeyFile, "webtransport-key-file", "", "TLS key for WebTransport")
+
+	fs.StringVar(&c.AuditSubject, "audit-subject", "", "NATS subject prefix to publish audit events to; off if empty")
+	fs.StringVar(&c.AuditDir, "audit-dir", "", "directory to write rotated JSONL audit logs to; off if empty")
+	fs.IntVar(&c.AuditMaxFileMB, "audit-max-file-mb", 100, "start a new audit log file once the current one reaches this size")
+	fs.IntVar(&c.AuditRetentionDays, "audit-retention-days", 30, "delete audit log files older than this many days; 0 keeps them forever")
+
+	fs.StringVar(&c.LogPII, "log-pii", "keep", "what to do with usernames and IPs in the logs: keep, hash or drop")
+	fs.StringVar(&c.LogPIIKey, "log-pii-key", "", "key for hashing usernames and IPs in the logs; a random one is used if empty")
 
 	err := fs.Parse(args)
 	return err
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"reflect"
+)
+
+// Redacted returns a copy of the config with the fields tagged
+// `secret:"true"` masked, for logging.
+func (c Config) Redacted() Config {
+	v := reflect.ValueOf(&c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") != "true" {
+			continue
+		}
+		f := v.Field(i)
+		if f.Kind() == reflect.String && f.String() != "" {
+			f.SetString("[redacted]")
+		}
+	}
+	return c
+}
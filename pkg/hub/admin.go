@@ -0,0 +1,311 @@
+package sockets
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/woogles-io/liwords/pkg/entity"
+
+	"github.com/woogles-io/liwords-socket/pkg/audit"
+	pb "github.com/woogles-io/liwords/rpc/api/proto/ipc"
+)
+
+// The admin API lets moderators see and manage the live connections on this
+// node. It is served on its own listener, and every request must carry the
+// admin token as a bearer token:
+//
+//	GET  /connections[?realm=R]  list connections, optionally only those in R
+//	GET  /realms                 list realms and how many connections each has
+//	POST /kick                   {"connID": ..., "userID": ..., "reason": ...}
+//	POST /notice                 {"realm": ..., "message": ...}
+//	POST /broadcast              {"audience": ..., "realmPrefix": ..., "kind": ...,
+//	                              "message": ..., "reconnectAt": ..., "shutdownAt": ...}
+//
+// /notice only reaches clients on this node; /broadcast goes out over NATS
+// to every node. See notice.go for the audiences.
+
+// ConnInfo describes a single connection, for the admin API.
+type ConnInfo struct {
+	Username      string   `json:"username"`
+	UserID        string   `json:"userID"`
+	ConnID        string   `json:"connID"`
+	Authenticated bool     `json:"authenticated"`
+	Realms        []string `json:"realms"`
+	AvgLagMs      int64    `json:"avgLagMs"`
+	IP            string   `json:"ip"`
+	QueueDepth    int      `json:"queueDepth"`
+	Transport     string   `json:"transport"`
+	Protocol      string   `json:"protocol"`
+}
+
+// An inspectRequest asks the hub for the connections in a realm, or all of
+// them if the realm is NullRealm.
+type inspectRequest struct {
+	realm Realm
+	reply chan []ConnInfo
+}
+
+// A kickRequest asks the hub to disconnect a single connection, or every
+// connection belonging to a user. The number kicked goes to reply.
+type kickRequest struct {
+	connID string
+	userID string
+	reason string
+	reply  chan int
+}
+
+func (c *Client) info() ConnInfo {
+	realms := make([]string, len(c.realms))
+	for i, r := range c.realms {
+		realms[i] = string(r)
+	}
+	c.RLock()
+	lag := c.avglag
+	c.RUnlock()
+	return ConnInfo{
+		Username:      c.username,
+		UserID:        c.userID,
+		ConnID:        c.connID,
+		Authenticated: c.authenticated,
+		Realms:        realms,
+		AvgLagMs:      int64(lag / time.Millisecond),
+		IP:            c.ip,
+		QueueDepth:    len(c.send),
+		Transport:     c.transport,
+		Protocol:      c.protocol,
+	}
+}
+
+// inspectConns is called from Run.
+func (h *Hub) inspectConns(req inspectRequest) {
+	conns := []ConnInfo{}
+	if req.realm == NullRealm {
+		for c := range h.clients {
+			conns = append(conns, c.info())
+		}
+	} else {
+		for c := range h.realms[req.realm] {
+			conns = append(conns, c.info())
+		}
+	}
+	req.reply <- conns
+}
+
+// kickConns is called from Run.
+func (h *Hub) kickConns(req kickRequest) {
+	toKick := []*Client{}
+	if req.connID != "" {
+		if c, ok := h.clientsByConnID[req.connID]; ok {
+			toKick = append(toKick, c)
+		}
+	}
+	if req.userID != "" {
+		for c := range h.clientsByUserID[req.userID] {
+			toKick = append(toKick, c)
+		}
+	}
+	kicked := 0
+	for _, c := range toKick {
+		// The same client may be in toKick twice if both IDs were given.
+		if _, ok := h.clients[c]; !ok {
+			continue
+		}
+		log.Info().Str("username", c.username).Str("connID", c.connID).
+			Str("reason", req.reason).Msg("kicking-client")
+		evt := c.auditEvent(audit.Kick)
+		evt.Reason = req.reason
+		h.audit.Log(evt)
+		h.closeClient(c, closeKicked, req.reason)
+		kicked++
+	}
+	req.reply <- kicked
+}
+
+// adminTimeout is how long an admin request waits for Run before giving up
+// with a 503, so that a stuck hub doesn't pile up hung requests.
+const adminTimeout = 5 * time.Second
+
+type adminHandler struct {
+	hub     *Hub
+	token   []byte
+	mux     *http.ServeMux
+	timeout time.Duration
+}
+
+// NewAdminHandler returns the admin API handler. token must be non-empty.
+func NewAdminHandler(h *Hub, token string) http.Handler {
+	a := &adminHandler{hub: h, token: []byte(token), mux: http.NewServeMux(), timeout: adminTimeout}
+	a.mux.HandleFunc("GET /connections", a.connections)
+	a.mux.HandleFunc("GET /realms", a.realms)
+	a.mux.HandleFunc("POST /kick", a.kick)
+	a.mux.HandleFunc("POST /notice", a.notice)
+	a.mux.HandleFunc("POST /broadcast", a.broadcast)
+	return a
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	given, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || len(a.token) == 0 || subtle.ConstantTimeCompare([]byte(given), a.token) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Err(err).Msg("admin-write-json")
+	}
+}
+
+// hubUnavailable answers a request that Run didn't get to in time.
+func hubUnavailable(w http.ResponseWriter, err error) {
+	log.Err(err).Msg("admin-hub-unavailable")
+	http.Error(w, "hub not responding", http.StatusServiceUnavailable)
+}
+
+// inspect asks Run for the connections in realm. It gives up when the
+// request is cancelled or after a.timeout; the reply channel is buffered so
+// that Run never blocks on an answer nobody is waiting for.
+func (a *adminHandler) inspect(ctx context.Context, realm Realm) ([]ConnInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	reply := make(chan []ConnInfo, 1)
+	select {
+	case a.hub.inspect <- inspectRequest{realm: realm, reply: reply}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case conns := <-reply:
+		return conns, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (a *adminHandler) connections(w http.ResponseWriter, r *http.Request) {
+	conns, err := a.inspect(r.Context(), Realm(r.URL.Query().Get("realm")))
+	if err != nil {
+		hubUnavailable(w, err)
+		return
+	}
+	writeJSON(w, conns)
+}
+
+func (a *adminHandler) realms(w http.ResponseWriter, r *http.Request) {
+	conns, err := a.inspect(r.Context(), NullRealm)
+	if err != nil {
+		hubUnavailable(w, err)
+		return
+	}
+	counts := map[string]int{}
+	for _, c := range conns {
+		for _, realm := range c.Realms {
+			counts[realm]++
+		}
+	}
+	type realmCount struct {
+		Realm string `json:"realm"`
+		Conns int    `json:"conns"`
+	}
+	realms := make([]realmCount, 0, len(counts))
+	for realm, n := range counts {
+		realms = append(realms, realmCount{Realm: realm, Conns: n})
+	}
+	sort.Slice(realms, func(i, j int) bool { return realms[i].Realm < realms[j].Realm })
+	writeJSON(w, realms)
+}
+
+func (a *adminHandler) kick(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ConnID string `json:"connID"`
+		UserID string `json:"userID"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.ConnID == "" && body.UserID == "" {
+		http.Error(w, "connID or userID is required", http.StatusBadRequest)
+		return
+	}
+	// Like inspect. If the request reached Run but the reply didn't come
+	// back in time, the kick may still happen.
+	ctx, cancel := context.WithTimeout(r.Context(), a.timeout)
+	defer cancel()
+	reply := make(chan int, 1)
+	select {
+	case a.hub.kick <- kickRequest{connID: body.ConnID, userID: body.UserID, reason: body.Reason, reply: reply}:
+	case <-ctx.Done():
+		hubUnavailable(w, ctx.Err())
+		return
+	}
+	select {
+	case kicked := <-reply:
+		writeJSON(w, map[string]int{"kicked": kicked})
+	case <-ctx.Done():
+		hubUnavailable(w, ctx.Err())
+	}
+}
+
+func (a *adminHandler) notice(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Realm   string `json:"realm"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Realm == "" || body.Message == "" {
+		http.Error(w, "realm and message are required", http.StatusBadRequest)
+		return
+	}
+	evt := entity.WrapEvent(&pb.ServerMessage{Message: body.Message}, pb.MessageType_SERVER_MESSAGE)
+	bts, err := evt.Serialize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("realm", body.Realm).Str("notice", body.Message).Msg("admin-notice")
+	a.hub.sendToRealm(r.Context(), Realm(body.Realm), bts)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminHandler) broadcast(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Audience    string `json:"audience"`
+		RealmPrefix string `json:"realmPrefix"`
+		Notice
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Message == "" {
+		http.Error(w, "message is required", http.StatusBadRequest)
+		return
+	}
+	if body.Audience == "" {
+		body.Audience = noticeAll
+	}
+	err := a.hub.publishNotice(body.Audience, body.RealmPrefix, body.Notice)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Info().Str("audience", body.Audience).Str("realm-prefix", body.RealmPrefix).
+		Str("notice", body.Message).Msg("admin-broadcast")
+	w.WriteHeader(http.StatusNoContent)
+}
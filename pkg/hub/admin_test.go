@@ -0,0 +1,63 @@
+package sockets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(ctx context.Context, a http.Handler, method, path, body string) int {
+	r := httptest.NewRequestWithContext(ctx, method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w.Code
+}
+
+// A hub that isn't running Run must not hang admin requests.
+func TestAdminHubNotResponding(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	a := NewAdminHandler(h, "admin-token")
+	a.(*adminHandler).timeout = 50 * time.Millisecond
+
+	for _, tc := range []struct{ method, path, body string }{
+		{http.MethodGet, "/connections", ""},
+		{http.MethodGet, "/realms", ""},
+		{http.MethodPost, "/kick", `{"userID":"u1"}`},
+	} {
+		start := time.Now()
+		if code := adminRequest(context.Background(), a, tc.method, tc.path, tc.body); code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.path, code, http.StatusServiceUnavailable)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s %s took %v", tc.method, tc.path, d)
+		}
+	}
+
+	// A caller that goes away doesn't wait out the timeout either.
+	a.(*adminHandler).timeout = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if code := adminRequest(ctx, a, http.MethodGet, "/connections", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("cancelled request: status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestAdminHubResponding(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	go h.Run()
+	a := NewAdminHandler(h, "admin-token")
+
+	for _, tc := range []struct{ method, path, body string }{
+		{http.MethodGet, "/connections", ""},
+		{http.MethodGet, "/realms", ""},
+		{http.MethodPost, "/kick", `{"userID":"u1"}`},
+	} {
+		if code := adminRequest(context.Background(), a, tc.method, tc.path, tc.body); code != http.StatusOK {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.path, code, http.StatusOK)
+		}
+	}
+}
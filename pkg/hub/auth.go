@@ -0,0 +1,134 @@
+package sockets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// Clients authenticate with a JWT from the liwords API. Query strings end up
+// in access logs and browser history, so the token can come in, in order of
+// preference:
+//
+//   - the Sec-WebSocket-Protocol header, as "liwords.auth.<token>", offered
+//     alongside liwords.v1 or liwords.v2. We never echo it back.
+//   - the liwords_socket_token cookie, which the API sets. Browsers send
+//     cookies with cross-site websocket handshakes, and websockets aren't
+//     covered by CORS, so any site could otherwise open a socket as its
+//     visitor. The cookie only counts if the request's Origin is one of
+//     the ALLOWED_ORIGINS; with none configured it is never used.
+//   - the first message after the upgrade, a text message holding
+//     {"type": "auth", "token": "<token>"}. It must arrive within
+//     cfg.AuthTimeout. Websocket only.
+//   - the token query parameter, while cfg.AllowTokenQueryParam is set. This
+//     is deprecated, and the token-query-param-uses counter tracks who still
+//     relies on it.
+
+const (
+	tokenProtocolPrefix = "liwords.auth."
+	tokenCookie         = "liwords_socket_token"
+	// maxAuthMessageSize is plenty for a token with a long perms claim.
+	maxAuthMessageSize = 4096
+)
+
+var tokenQueryParamUses = expvar.NewInt("token-query-param-uses")
+
+// requestToken returns the token the request carries, if any.
+func (h *Hub) requestToken(r *http.Request) string {
+	for _, p := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(p, tokenProtocolPrefix); ok && token != "" {
+			return token
+		}
+	}
+	if cookie, err := r.Cookie(tokenCookie); err == nil && cookie.Value != "" {
+		if originAllowlisted(r) {
+			return cookie.Value
+		}
+		log.Warn().Str("origin", r.Header.Get("Origin")).Msg("token-cookie-refused")
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		if !h.cfg.AllowTokenQueryParam {
+			log.Warn().Msg("token-query-param-refused")
+			return ""
+		}
+		tokenQueryParamUses.Add(1)
+		return token
+	}
+	return ""
+}
+
+type authMessage struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+}
+
+// readAuthMessage reads the token from the first message on the socket.
+func readAuthMessage(conn *websocket.Conn, timeout time.Duration) (string, error) {
+	conn.SetReadLimit(maxAuthMessageSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	mt, data, err := conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	if mt != websocket.TextMessage {
+		return "", errors.New("expected an auth message")
+	}
+	var msg authMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "auth" || msg.Token == "" {
+		return "", errors.New("expected an auth message")
+	}
+	return msg.Token, nil
+}
+
+// redactToken returns enough of a token to tell tokens apart in the logs,
+// but not enough to use it.
+func redactToken(token string) string {
+	if len(token) <= 24 {
+		return "[redacted]"
+	}
+	return "[redacted]..." + token[len(token)-6:]
+}
+
+// An admitError says why admit turned a client away, in both HTTP and
+// websocket close terms.
+type admitError struct {
+	status int
+	code   closeCode
+	err    error
+}
+
+func (e *admitError) Error() string {
+	return e.err.Error()
+}
+
+// admit logs the client in with its token and checks that it may connect.
+// If it returns nil the client holds a connection from the limiter.
+func (h *Hub) admit(ctx context.Context, c *Client, connID string) *admitError {
+	_, span := tracer.Start(ctx, "socketLogin")
+	err := h.socketLogin(c)
+	endSpan(span, err)
+	if err != nil {
+		return &admitError{http.StatusUnauthorized, closeAuthFailed, errors.New("invalid token")}
+	}
+	if err := h.assignConnID(c, connID); err != nil {
+		log.Err(err).Str("username", c.username).Msg("conn-id")
+		return &admitError{http.StatusBadRequest, closeBadConnID, err}
+	}
+	if h.bans.banned(c) {
+		log.Info().Str("username", c.username).Str("ip", c.ip).Str("transport", c.transport).Msg("banned")
+		return &admitError{http.StatusForbidden, closeBanned, errors.New("banned")}
+	}
+	if err := h.limiter.acquire(c); err != nil {
+		log.Err(err).Str("username", c.username).Str("ip", c.ip).Msg("conn-limit")
+		return &admitError{http.StatusTooManyRequests, closeTooManyConns, err}
+	}
+	return nil
+}
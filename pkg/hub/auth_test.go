@@ -0,0 +1,122 @@
+package sockets
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// setAllowedOrigins sets AllowedOrigins for the test.
+func setAllowedOrigins(t *testing.T, origins ...string) {
+	old := AllowedOrigins
+	AllowedOrigins = origins
+	t.Cleanup(func() { AllowedOrigins = old })
+}
+
+// A page on another site can make the browser open a socket with the
+// visitor's cookie; that must not log it in as the visitor.
+func TestCookieAcrossOrigins(t *testing.T) {
+	const (
+		site = "https://woogles.io"
+		evil = "https://evil.example"
+	)
+	for _, tc := range []struct {
+		name    string
+		allowed []string
+		origin  string
+		// status is the handshake's; 101 if it is upgraded.
+		status int
+		// loggedIn says whether the cookie should have logged us in.
+		loggedIn bool
+	}{
+		{"no allowlist", nil, evil, http.StatusSwitchingProtocols, false},
+		{"no allowlist, no origin", nil, "", http.StatusSwitchingProtocols, false},
+		{"other origin", []string{site}, evil, http.StatusForbidden, false},
+		{"allowed origin", []string{site}, site, http.StatusSwitchingProtocols, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setAllowedOrigins(t, tc.allowed...)
+			h := newTestHub(t, newTestNats(t), "-auth-timeout", "100ms")
+			url := serveTestWS(t, h) + "/ws?path=/"
+
+			header := http.Header{}
+			header.Set("Cookie", tokenCookie+"="+newTestToken(t, "u1", nil))
+			if tc.origin != "" {
+				header.Set("Origin", tc.origin)
+			}
+			d := websocket.Dialer{Subprotocols: []string{protocolV2}}
+			ws, resp, err := d.Dial(url, header)
+			if resp == nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.status {
+				t.Fatalf("handshake status = %d, want %d", resp.StatusCode, tc.status)
+			}
+			if ws == nil {
+				return
+			}
+			defer ws.Close()
+
+			if tc.loggedIn {
+				if info := waitForConns(t, h, 1)[0]; info.UserID != "u1" {
+					t.Errorf("logged in as %q, want u1", info.UserID)
+				}
+				return
+			}
+			// The server is still waiting for an auth message, and gives
+			// up on it.
+			_, _, err = ws.ReadMessage()
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) || ce.Code != int(closeAuthFailed) {
+				t.Errorf("read = %v, want close %d", err, closeAuthFailed)
+			}
+			if n := connCount(h); n != 0 {
+				t.Errorf("hub has %d clients, want 0", n)
+			}
+		})
+	}
+}
+
+func TestSSECookieAcrossOrigins(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	r := httptest.NewRequest(http.MethodGet, "/sse?path=/", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	r.AddCookie(&http.Cookie{Name: tokenCookie, Value: newTestToken(t, "u1", nil)})
+	w := httptest.NewRecorder()
+	ServeSSE(h, w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSSESendOrigin(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	c := newTestClient(h, "u1", "c1")
+	c.transport = transportSSE
+	c.sseOrigin = "https://woogles.io"
+	h.addSSESession("s1", c)
+
+	for _, tc := range []struct {
+		origin string
+		status int
+	}{
+		{"https://evil.example", http.StatusForbidden},
+		{"", http.StatusForbidden},
+		{"https://woogles.io", http.StatusNoContent},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/sse/send?session=s1",
+			strings.NewReader("\x00\x03\x09hi"))
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		ServeSSESend(h, w, r)
+		if w.Code != tc.status {
+			t.Errorf("origin %q: status = %d, want %d", tc.origin, w.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package sockets
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/woogles-io/liwords-socket/pkg/audit"
+)
+
+// The ban list turns away banned users and abusive IPs at the socket edge,
+// before they cost us a registerRealm round-trip. It is loaded from a local
+// JSON file at startup, and kept up to date over NATS:
+//
+//	bans.add       ban the users and IPs in the payload
+//	bans.remove    lift the bans on the users and IPs in the payload
+//
+// The payload, and the file, is a JSON banUpdate. IPs may be single
+// addresses or CIDRs. Sockets that match a new ban are closed with a
+// policy-violation close code (closeBanned). Updates are written back to the file, so
+// they survive a restart.
+
+// A banUpdate is a set of user IDs and IP ranges.
+type banUpdate struct {
+	Users  []string `json:"users,omitempty"`
+	IPs    []string `json:"ips,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+type banList struct {
+	sync.RWMutex
+	file  string
+	users map[string]bool
+	ips   map[netip.Prefix]bool
+}
+
+// newBanList loads the ban list from file. If file is empty the list starts
+// out empty and isn't saved anywhere.
+func newBanList(file string) (*banList, error) {
+	b := &banList{
+		file:  file,
+		users: make(map[string]bool),
+		ips:   make(map[netip.Prefix]bool),
+	}
+	if file == "" {
+		return b, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u banUpdate
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	if _, err := b.apply(u, true); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func parseBanIP(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// apply adds the bans in u, or removes them if add is false. It returns the
+// parsed IP ranges.
+func (b *banList) apply(u banUpdate, add bool) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(u.IPs))
+	for _, ip := range u.IPs {
+		prefix, err := parseBanIP(ip)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	b.Lock()
+	defer b.Unlock()
+	for _, user := range u.Users {
+		if add {
+			b.users[user] = true
+		} else {
+			delete(b.users, user)
+		}
+	}
+	for _, prefix := range prefixes {
+		if add {
+			b.ips[prefix] = true
+		} else {
+			delete(b.ips, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// save writes the list back to its file.
+func (b *banList) save() error {
+	if b.file == "" {
+		return nil
+	}
+	b.RLock()
+	u := banUpdate{}
+	for user := range b.users {
+		u.Users = append(u.Users, user)
+	}
+	for prefix := range b.ips {
+		u.IPs = append(u.IPs, prefix.String())
+	}
+	b.RUnlock()
+	sort.Strings(u.Users)
+	sort.Strings(u.IPs)
+	data, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write and rename, so we never leave a half-written file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(b.file), filepath.Base(b.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.file)
+}
+
+// banned says whether the client, which must have logged in, is banned.
+func (b *banList) banned(c *Client) bool {
+	b.RLock()
+	defer b.RUnlock()
+	if c.userID != "" && b.users[c.userID] {
+		return true
+	}
+	return matchesIP(b.ips, c.ip)
+}
+
+func matchesIP(prefixes map[netip.Prefix]bool, ip string) bool {
+	if len(prefixes) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleBanUpdate is called from PubsubProcess.
+func (h *Hub) handleBanUpdate(action string, data []byte) {
+	var u banUpdate
+	if err := json.Unmarshal(data, &u); err != nil {
+		log.Err(err).Msg("bad-ban-update")
+		return
+	}
+	var add bool
+	switch action {
+	case "add":
+		add = true
+	case "remove":
+		add = false
+	default:
+		log.Error().Str("action", action).Msg("unknown-ban-action")
+		return
+	}
+	prefixes, err := h.bans.apply(u, add)
+	if err != nil {
+		log.Err(err).Msg("bad-ban-update")
+		return
+	}
+	log.Info().Str("action", action).Strs("users", u.Users).Strs("ips", u.IPs).
+		Str("reason", u.Reason).Msg("ban-update")
+	if err := h.bans.save(); err != nil {
+		log.Err(err).Msg("saving-ban-list")
+	}
+	if add {
+		h.enforceBans <- banEnforcement{update: u, prefixes: prefixes}
+	}
+}
+
+// A banEnforcement asks the hub to close the sockets matching new bans.
+type banEnforcement struct {
+	update   banUpdate
+	prefixes []netip.Prefix
+}
+
+// closeBanned is called from Run.
+func (h *Hub) closeBanned(e banEnforcement) {
+	users := make(map[string]bool, len(e.update.Users))
+	for _, user := range e.update.Users {
+		users[user] = true
+	}
+	ips := make(map[netip.Prefix]bool, len(e.prefixes))
+	for _, prefix := range e.prefixes {
+		ips[prefix] = true
+	}
+	reason := e.update.Reason
+	if reason == "" {
+		reason = "banned"
+	}
+	for c := range h.clients {
+		if !users[c.userID] && !matchesIP(ips, c.ip) {
+			continue
+		}
+		log.Info().Str("username", c.username).Str("connID", c.connID).
+			Str("reason", reason).Msg("closing-banned-client")
+		evt := c.auditEvent(audit.Ban)
+		evt.Reason = reason
+		h.audit.Log(evt)
+		h.closeClient(c, closeBanned, reason)
+	}
+}
@@ -4,15 +4,21 @@ package sockets
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// "github.com/woogles-io/liwords/pkg/entity"
 	"github.com/gorilla/websocket"
+	"github.com/quic-go/webtransport-go"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/woogles-io/liwords/pkg/entity"
@@ -30,6 +36,9 @@ func init() {
 		}
 	}
 	log.Info().Interface("AllowedOrigins", AllowedOrigins).Msg("set allowed origins")
+	if len(AllowedOrigins) == 0 {
+		log.Warn().Msg("no ALLOWED_ORIGINS; the token cookie will be ignored")
+	}
 }
 
 const (
@@ -44,24 +53,52 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
+
+	// Maximum message size allowed from a peer using the JSON protocol.
+	maxJSONMessageSize = 8 * maxMessageSize
 )
 
+// checkOrigin reports whether the request comes from one of the
+// AllowedOrigins. All origins are allowed if none are configured.
+func checkOrigin(r *http.Request) bool {
+	return len(AllowedOrigins) == 0 || originAllowlisted(r)
+}
+
+// originAllowlisted reports whether the request's Origin is one of the
+// AllowedOrigins. Unlike checkOrigin, it is false if none are configured.
+func originAllowlisted(r *http.Request) bool {
+	originHeader := r.Header.Get("Origin")
+	// https://woogles.io or https://www.woogles.io on production, for example.
+	for _, origin := range AllowedOrigins {
+		if originHeader == origin {
+			return true
+		}
+	}
+	return false
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		if len(AllowedOrigins) == 0 {
-			return true
-		}
-		originHeader := r.Header.Get("Origin")
-		// https://woogles.io or https://www.woogles.io on production, for example.
-		for _, origin := range AllowedOrigins {
-			if originHeader == origin {
-				return true
-			}
-		}
-		return false
-	},
+	CheckOrigin:     checkOrigin,
+	Subprotocols:    supportedProtocols,
+}
+
+const (
+	transportWebsocket    = "ws"
+	transportSSE          = "sse"
+	transportWebTransport = "wt"
+)
+
+// An outboundFrame is a message queued for delivery to a single client.
+// Realm broadcasts carry a prepared message as well, so that the websocket
+// framing (and compression, if negotiated) is done once for the whole realm
+// rather than once per socket. data is always set. Control frames hold a
+// JSON control message rather than binary events.
+type outboundFrame struct {
+	data     []byte
+	prepared *websocket.PreparedMessage
+	control  bool
 }
 
 // Client is a middleman between the websocket connection and the hub.
@@ -69,14 +106,26 @@ type Client struct {
 	sync.RWMutex
 	hub *Hub
 
-	// The websocket connection.
+	// The websocket connection. It is nil for clients that are not using
+	// the websocket transport.
 	conn *websocket.Conn
+	// wtSession and wtStream are the WebTransport session and its message
+	// stream, for clients using that transport.
+	wtSession *webtransport.Session
+	wtStream  *webtransport.Stream
+	// sseOrigin is the Origin the SSE stream was opened from. Upstream
+	// POSTs must come from the same one.
+	sseOrigin string
+	// transport is one of the transport* constants.
+	transport string
 
 	// Buffered channel of outbound messages.
-	send chan []byte
+	send chan outboundFrame
 
 	authenticated bool
 	username      string
+	// perms are the user's permissions from their token, e.g. "adm".
+	perms []string
 	// userID is the user database ID, and it should contain solely of base57
 	// chars, so we should use it as much as possible.
 	userID string
@@ -90,12 +139,58 @@ type Client struct {
 	tempRealms []string
 	connID     string
 	connToken  string
-
-	forwardedFor string
+	// tokenConnID is the connection ID the token was issued for, if any.
+	tokenConnID string
+	// connectedAt is when the connection was accepted, for the audit log.
+	connectedAt time.Time
+
+	// protocol is the negotiated subprotocol; see protocol.go.
+	protocol string
+	// capabilities are the protocol features that are on for this
+	// connection.
+	capabilities Capability
+
+	// state is where the client is in its lifecycle; see lifecycle.go.
+	// stateMu guards it, along with closeCode and closeReason, which tell
+	// the peer why we hung up on them.
+	stateMu     sync.Mutex
+	state       connState
+	closeCode   closeCode
+	closeReason string
+	// held are the messages the client sent while pending; stateMu
+	// guards them too.
+	held []heldMessage
+	// degraded is set if we couldn't register the client's realms and put
+	// it in read-only lobby mode instead; see realms.go.
+	degraded atomic.Bool
+
+	// ip is the client's address; see clientip.go.
+	ip string
+	// limited is set while the client holds a connection from the
+	// limiter. The limiter's lock guards it.
+	limited      bool
 	pongCount    int
 	lastPingSent time.Time
 	// The round-trip lag; it is a sort of average.
 	avglag time.Duration
+
+	// Connection quality; see quality.go. The client's lock guards these,
+	// like the lag fields above.
+	pingsSent        int
+	awaitingPong     bool
+	answered         [qualityWindow]bool
+	rtts             [qualityWindow]time.Duration
+	recentReconnects int
+	lastRating       string
+}
+
+func (c *Client) hasPerm(perm string) bool {
+	for _, p := range c.perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *Client) sendError(err error) {
@@ -106,12 +201,15 @@ func (c *Client) sendError(err error) {
 		log.Err(err).Msg("error serializing error, lol")
 		return
 	}
-	c.send <- bts
+	c.enqueue(outboundFrame{data: bts})
 }
 
 func (c *Client) sendLatency() {
+	c.RLock()
+	lag := c.avglag
+	c.RUnlock()
 	evt := entity.WrapEvent(
-		&pb.LagMeasurement{LagMs: int32(c.avglag / time.Millisecond)},
+		&pb.LagMeasurement{LagMs: int32(lag / time.Millisecond)},
 		pb.MessageType_LAG_MEASUREMENT)
 	bts, err := evt.Serialize()
 	if err != nil {
@@ -119,7 +217,56 @@ func (c *Client) sendLatency() {
 		log.Err(err).Msg("error serializing lag...")
 		return
 	}
-	c.send <- bts
+	c.enqueue(outboundFrame{data: bts})
+}
+
+// recordLag folds a new round-trip measurement into the client's average
+// lag and reports it back to the client. It is called once per pong (or
+// whatever the transport's equivalent is).
+func (c *Client) recordLag(curlag time.Duration) error {
+	c.Lock()
+	c.pongReceived(curlag)
+	c.pongCount++
+	var mix float64
+	// Decaying average after the first four pongs. Thx lichess.
+	if c.pongCount > 4 {
+		mix = 0.1
+	} else {
+		mix = 1 / float64(c.pongCount)
+	}
+	c.avglag += time.Duration(mix * (float64(curlag) - float64(c.avglag)))
+	c.Unlock()
+
+	if c.pongCount%10 == 2 {
+		log.Info().Float64("curlag-ms", float64(curlag)/float64(time.Millisecond)).
+			Float64("avglag-ms", float64(c.avglag)/float64(time.Millisecond)).
+			Str("username", c.username).
+			Int("pong-count", c.pongCount).
+			Str("ips", c.ip).
+			Str("connID", c.connID).
+			Str("transport", c.transport).
+			Msg("got-pong")
+
+		// Also, send a message via NATS to renew presence channel expirations.
+		// Let's do this every 10 pings instead of every ping. We don't need
+		// to stress Redis that often.
+		req := &pb.Pong{
+			Ips: c.ip,
+		}
+
+		data, err := proto.Marshal(req)
+		if err != nil {
+			return err
+		}
+		c.hub.pubsub.publish(extendTopic(c, "ipc.pb.pongReceived"), data)
+	} //else {
+	// This might be too noisy even for debug but let's enable this
+	// for a bit.
+	//log.Debug().Str("username", c.username).Msg("single-pong")
+	//}
+	c.sendLatency()
+	c.reportQuality()
+	return nil
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -132,56 +279,23 @@ func (c *Client) readPump() {
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
+	if c.hasCapability(CapJSON) {
+		c.conn.SetReadLimit(maxJSONMessageSize)
+	} else {
+		c.conn.SetReadLimit(maxMessageSize)
+	}
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		received := time.Now()
 		c.RLock()
 		curlag := received.Sub(c.lastPingSent)
 		c.RUnlock()
-		c.pongCount++
-		var mix float64
-		// Decaying average after the first four pongs. Thx lichess.
-		if c.pongCount > 4 {
-			mix = 0.1
-		} else {
-			mix = 1 / float64(c.pongCount)
-		}
-		c.avglag += time.Duration(mix * (float64(curlag) - float64(c.avglag)))
-
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		if c.pongCount%10 == 2 {
-			log.Info().Float64("curlag-ms", float64(curlag)/float64(time.Millisecond)).
-				Float64("avglag-ms", float64(c.avglag)/float64(time.Millisecond)).
-				Str("username", c.username).
-				Int("pong-count", c.pongCount).
-				Str("ips", c.forwardedFor).
-				Str("connID", c.connID).
-				Msg("got-pong")
-
-			// Also, send a message via NATS to renew presence channel expirations.
-			// Let's do this every 10 pings instead of every ping. We don't need
-			// to stress Redis that often.
-			req := &pb.Pong{
-				Ips: c.forwardedFor,
-			}
-
-			data, err := proto.Marshal(req)
-			if err != nil {
-				return err
-			}
-			c.hub.pubsub.natsconn.Publish(extendTopic(c, "ipc.pb.pongReceived"), data)
-		} //else {
-		// This might be too noisy even for debug but let's enable this
-		// for a bit.
-		//log.Debug().Str("username", c.username).Msg("single-pong")
-		//}
-		c.sendLatency()
-		return nil
+		return c.recordLag(curlag)
 	})
 	for {
 		// _, message, err
-		_, message, err := c.conn.ReadMessage()
+		mt, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Err(err).Msg("unexpected-close")
@@ -191,6 +305,15 @@ func (c *Client) readPump() {
 			break
 		}
 
+		if c.hasCapability(CapJSON) && mt == websocket.TextMessage {
+			message, err = jsonToFrame(message)
+			if err != nil {
+				log.Err(err).Str("username", c.username).Msg("json-to-frame")
+				c.sendError(err)
+				continue
+			}
+		}
+
 		// Here is where we parse the message and send something off to the hub
 		// potentially.
 
@@ -219,30 +342,21 @@ func (c *Client) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
+		case frame, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				msg := []byte{}
+				if c.closeCode != 0 {
+					msg = websocket.FormatCloseMessage(int(c.closeCode), c.closeReason)
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, msg)
 				log.Info().Msg("hub closed channel")
 				// XXX: should we remove the connection here??
 				// maybe not since the connection close happens in the defer.
 				return
 			}
-
-			w, err := c.conn.NextWriter(websocket.BinaryMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+			if err := c.writeFrames(frame); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -251,16 +365,90 @@ func (c *Client) writePump() {
 				return
 			}
 			c.Lock()
-			c.lastPingSent = time.Now()
+			c.pingSent(time.Now())
 			c.Unlock()
 		}
 	}
 }
 
-// close connection with an error string.
-func closeMessage(ws *websocket.Conn, errStr string) {
-	// close code 1008 is used for a generic "policy violation" message.
-	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, errStr)
+// writeFrames writes the given frame, along with anything else already queued
+// on the send channel. Consecutive raw frames are coalesced into a single
+// websocket message; prepared frames are shared with other clients and must
+// go out as messages of their own. Clients using the JSON protocol get one
+// text message per event instead.
+func (c *Client) writeFrames(first outboundFrame) error {
+	var w io.WriteCloser
+	flush := func() error {
+		if w == nil {
+			return nil
+		}
+		err := w.Close()
+		w = nil
+		return err
+	}
+	write := func(frame outboundFrame) error {
+		if frame.control {
+			if err := flush(); err != nil {
+				return err
+			}
+			return c.conn.WriteMessage(websocket.TextMessage, frame.data)
+		}
+		if c.hasCapability(CapJSON) {
+			if err := flush(); err != nil {
+				return err
+			}
+			docs, err := framesToJSON(frame.data)
+			if err != nil {
+				// Drop what we can't translate rather than the connection.
+				log.Err(err).Str("username", c.username).Msg("frames-to-json")
+				return nil
+			}
+			for _, doc := range docs {
+				if err := c.conn.WriteMessage(websocket.TextMessage, doc); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if frame.prepared != nil {
+			if err := flush(); err != nil {
+				return err
+			}
+			return c.conn.WritePreparedMessage(frame.prepared)
+		}
+		if w == nil {
+			var err error
+			w, err = c.conn.NextWriter(websocket.BinaryMessage)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := w.Write(frame.data)
+		return err
+	}
+
+	if err := write(first); err != nil {
+		return err
+	}
+	// Add queued messages to the current websocket message.
+	n := len(c.send)
+	for i := 0; i < n; i++ {
+		frame, ok := <-c.send
+		if !ok {
+			// The hub closed the channel; writePump will notice on its
+			// next receive.
+			break
+		}
+		if err := write(frame); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// close connection with a code and an error string.
+func closeMessage(ws *websocket.Conn, code closeCode, errStr string) {
+	msg := websocket.FormatCloseMessage(int(code), errStr)
 	log.Debug().Str("closemsg", string(msg)).Msg("writing close message")
 	err := ws.WriteMessage(websocket.CloseMessage, msg)
 	if err != nil {
@@ -269,68 +457,101 @@ func closeMessage(ws *websocket.Conn, errStr string) {
 	ws.Close()
 }
 
+// connParams returns the path and connection ID query parameters. The token
+// is handled separately; see auth.go.
+func connParams(r *http.Request) (path, connID string, err error) {
+	path = r.URL.Query().Get("path")
+	if path == "" {
+		return "", "", errors.New("path is missing")
+	}
+	// The connection ID is optional; see connid.go.
+	return path, r.URL.Query().Get("cid"), nil
+}
+
 // ServeWS handles websocket requests from the peer. This runs in its own
 // goroutine.
 func ServeWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	fwd := r.Header.Values("X-Forwarded-For")
-	tokens, ok := r.URL.Query()["token"]
-	log.Debug().Interface("ips", fwd).Msg("servews-new-conn")
-	if !ok || len(tokens[0]) < 1 {
-		log.Error().Msg("token is missing")
-		return
-	}
-	paths, ok := r.URL.Query()["path"]
-	if !ok || len(paths[0]) < 1 {
-		log.Error().Msg("path is missing")
+	ctx, span := tracer.Start(r.Context(), "connect", trace.WithAttributes(
+		attribute.String("transport", transportWebsocket)))
+	var err error
+	defer func() { endSpan(span, err) }()
+
+	ip := hub.proxies.clientIP(r)
+	log.Debug().Str("ip", ip).Msg("servews-new-conn")
+	path, connID, err := connParams(r)
+	if err != nil {
+		log.Error().Msg(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	connIDs, ok := r.URL.Query()["cid"]
-	if !ok || len(connIDs[0]) < 1 {
-		log.Error().Msg("connID is missing")
-		return
+	client := &Client{
+		hub:         hub,
+		transport:   transportWebsocket,
+		send:        make(chan outboundFrame, 256),
+		connToken:   hub.requestToken(r),
+		ip:          ip,
+		connectedAt: time.Now(),
+	}
+	// The protocol and capabilities depend only on the request, and
+	// assignConnID needs them.
+	client.protocol = requestedProtocol(r)
+	client.capabilities = hub.negotiateCapabilities(client, r)
+
+	// If we have the token already, log in and check the connection caps
+	// before upgrading, so that we can turn the client away with a proper
+	// HTTP status.
+	admitted := false
+	if client.connToken != "" {
+		if aerr := hub.admit(ctx, client, connID); aerr != nil {
+			err = aerr
+			http.Error(w, aerr.Error(), aerr.status)
+			return
+		}
+		admitted = true
 	}
 
-	token := tokens[0]
-	path := paths[0]
-	connID := connIDs[0]
-
-	conn, err := upgrader.Upgrade(w, r, nil)
+	u := upgrader
+	u.EnableCompression = hub.cfg.WebsocketCompression
+	client.conn, err = u.Upgrade(w, r, nil)
 	if err != nil {
 		log.Err(err).Msg("upgrading socket")
+		hub.limiter.release(client)
 		return
 	}
 
-	client := &Client{
-		hub:          hub,
-		conn:         conn,
-		send:         make(chan []byte, 256),
-		connID:       connID,
-		connToken:    token,
-		forwardedFor: strings.Join(fwd, ","),
+	if !admitted {
+		client.connToken, err = readAuthMessage(client.conn, hub.cfg.AuthTimeout)
+		if err != nil {
+			log.Err(err).Str("ip", ip).Msg("socket-auth-message")
+			closeMessage(client.conn, closeAuthFailed, "authentication failed")
+			return
+		}
+		if aerr := hub.admit(ctx, client, connID); aerr != nil {
+			err = aerr
+			closeMessage(client.conn, aerr.code, aerr.Error())
+			return
+		}
 	}
+	span.SetAttributes(attribute.String("conn.id", client.connID))
 
-	// First, verify connection token
-	err = hub.socketLogin(client)
-	if err != nil {
-		log.Err(err).Msg("socket-login-error")
-		client.conn.Close()
+	if client.hasCapability(CapJSON) && !hub.serverCapabilities(client).has(CapJSON) {
+		log.Error().Str("username", client.username).Msg("json-protocol-not-allowed")
+		closeMessage(client.conn, closeProtocolNotAllowed, "json protocol not allowed")
+		hub.limiter.release(client)
 		return
 	}
+	log.Debug().Str("connID", client.connID).Str("protocol", client.protocol).
+		Strs("capabilities", client.capabilities.Names()).Msg("negotiated-protocol")
 
-	// Then try to register the realm with the connection path that was
-	// passed in.
-	err = registerRealm(client, path, hub)
-	if err != nil {
-		log.Err(err).Msg("register-realm-error")
-		client.conn.Close()
-	}
-
-	client.hub.register <- client
+	// The hello goes out before anything the hub sends.
+	client.sendHello()
 
 	// Allow collection of memory referenced by the caller by doing all work in
-	// new goroutines.
+	// new goroutines. The realms are registered in the background; see
+	// realms.go.
 	go client.writePump()
 	go client.readPump()
-	log.Debug().Str("connID", connID).Msg("leaving-servews")
+	go hub.registerAsync(context.WithoutCancel(ctx), client, path)
+	log.Debug().Str("connID", client.connID).Msg("leaving-servews")
 }
@@ -0,0 +1,96 @@
+package sockets
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// discardConn is a net.Conn that throws away whatever is written to it, so
+// that benchmarks measure our side of a write and not the network.
+type discardConn struct{}
+
+func (discardConn) Read(b []byte) (int, error)         { select {} }
+func (discardConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (discardConn) Close() error                       { return nil }
+func (discardConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (discardConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (discardConn) SetDeadline(t time.Time) error      { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// hijackRecorder lets the upgrader take over a discardConn.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c := discardConn{}
+	return c, bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c)), nil
+}
+
+// newDiscardWebsocket returns a server-side websocket whose peer discards
+// everything.
+func newDiscardWebsocket(b *testing.B, compress bool) *websocket.Conn {
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-Websocket-Version", "13")
+	r.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if compress {
+		r.Header.Set("Sec-Websocket-Extensions", "permessage-deflate")
+	}
+	u := websocket.Upgrader{EnableCompression: compress}
+	ws, err := u.Upgrade(hijackRecorder{httptest.NewRecorder()}, r, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return ws
+}
+
+// BenchmarkRealmBroadcast compares sending one message to every member of
+// a big realm the way Run does, with a PreparedMessage shared by all of
+// them, against framing it for each socket with NextWriter.
+func BenchmarkRealmBroadcast(b *testing.B) {
+	const members = 10000
+	msg := []byte(strings.Repeat(`{"event":"gameHistoryRefresher","turn":12}`, 20))
+
+	for _, compress := range []bool{false, true} {
+		clients := make([]*Client, members)
+		for i := range clients {
+			clients[i] = &Client{
+				conn:     newDiscardWebsocket(b, compress),
+				send:     make(chan outboundFrame),
+				username: fmt.Sprint("u", i),
+			}
+		}
+		for _, prepared := range []bool{false, true} {
+			name := fmt.Sprintf("compress=%v/prepared=%v", compress, prepared)
+			b.Run(name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					frame := outboundFrame{data: msg}
+					if prepared {
+						pm, err := websocket.NewPreparedMessage(websocket.BinaryMessage, msg)
+						if err != nil {
+							b.Fatal(err)
+						}
+						frame.prepared = pm
+					}
+					for _, c := range clients {
+						if err := c.writeFrames(frame); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
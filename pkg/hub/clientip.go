@@ -0,0 +1,154 @@
+package sockets
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// We need the real IP of each client for rate limits, bans and the audit
+// log, but we usually sit behind a load balancer, so the peer address is
+// that of a proxy. Proxies tell us who they are forwarding for with one of
+// these headers:
+//
+//	Forwarded: for=192.0.2.60;proto=https, for="[2001:db8::1]:4711"  (RFC 7239)
+//	X-Forwarded-For: 192.0.2.60, 198.51.100.17
+//	X-Real-IP: 192.0.2.60
+//
+// Anyone can send these headers, so they only count if the peer is a trusted
+// proxy. Each proxy appends the address it got the request from, so we walk
+// the list from the right, skipping trusted proxies; the first address that
+// isn't one is the client.
+//
+// A proxy only looks after the header it sets, and passes the others along
+// as the client sent them. So we read just the one header our proxies set,
+// chosen with -client-ip-header, and never fall back to another: a client
+// could otherwise send Forwarded: for=<anyone> through a proxy that only
+// sets X-Forwarded-For, and get past bans and the per-IP caps.
+
+// clientIPHeaders are the headers -client-ip-header may name.
+var clientIPHeaders = []string{"x-forwarded-for", "forwarded", "x-real-ip"}
+
+type proxyResolver struct {
+	trusted []netip.Prefix
+	// header is the canonical name of the header our proxies set.
+	header string
+}
+
+// newProxyResolver parses a comma-separated list of CIDRs. Bare addresses
+// are taken as single hosts. header is the one forwarding header to read.
+func newProxyResolver(cidrs, header string) (*proxyResolver, error) {
+	if !slices.Contains(clientIPHeaders, strings.ToLower(header)) {
+		return nil, fmt.Errorf("client IP header %q is not one of %s",
+			header, strings.Join(clientIPHeaders, ", "))
+	}
+	p := &proxyResolver{header: http.CanonicalHeaderKey(header)}
+	for _, s := range strings.Split(cidrs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			p.trusted = append(p.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		p.trusted = append(p.trusted, prefix.Masked())
+	}
+	return p, nil
+}
+
+func (p *proxyResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range p.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request.
+func (p *proxyResolver) clientIP(r *http.Request) string {
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !p.isTrusted(peer) {
+		return peer.String()
+	}
+
+	var hops []string
+	values := r.Header.Values(p.header)
+	switch p.header {
+	case "Forwarded":
+		hops = forwardedFor(values)
+	case "X-Forwarded-For":
+		for _, v := range values {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	case "X-Real-Ip":
+		// The proxy sets this rather than adding to it, so only the last
+		// one is the proxy's.
+		if len(values) > 0 {
+			hops = values[len(values)-1:]
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHostAddr(strings.TrimSpace(hops[i]))
+		if !ok {
+			// "unknown", an obfuscated identifier, or junk. We can't see
+			// past it, so the last proxy we trust is as close as we get.
+			break
+		}
+		client = addr
+		if !p.isTrusted(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor returns the for= parameters of RFC 7239 Forwarded headers,
+// one per hop. Hops without one come back empty.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			hop := ""
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hop = strings.Trim(v, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseHostAddr parses an IP address that may have a port and, for IPv6,
+// brackets.
+func parseHostAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
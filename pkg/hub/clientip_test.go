@@ -0,0 +1,184 @@
+package sockets
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	const trusted = "10.0.0.0/8,fc00::/7"
+	for _, tc := range []struct {
+		name    string
+		header  string
+		peer    string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name: "untrusted peer",
+			peer: "203.0.113.9:5555",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1"},
+				"Forwarded":       {"for=198.51.100.2"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:    "trusted proxy",
+			peer:    "10.0.0.1:5555",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.9"}},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "trusted proxy without the header",
+			peer:    "10.0.0.1:5555",
+			headers: map[string][]string{"X-Real-Ip": {"203.0.113.9"}},
+			want:    "10.0.0.1",
+		},
+		{
+			// Our proxy only sets X-Forwarded-For; the client made up the
+			// Forwarded header.
+			name: "spoofed Forwarded behind an XFF proxy",
+			peer: "10.0.0.1:5555",
+			headers: map[string][]string{
+				"Forwarded":       {"for=198.51.100.66"},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			// The client sent its own X-Forwarded-For, which the proxy
+			// appended to.
+			name:    "spoofed XFF",
+			peer:    "10.0.0.1:5555",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.66, 203.0.113.9"}},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "spoofed XFF that claims to be a proxy",
+			peer:    "10.0.0.1:5555",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.66, 10.9.9.9, 203.0.113.9"}},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "multiple trusted hops",
+			peer:    "10.0.0.1:5555",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.9, 10.1.1.1", "10.2.2.2"}},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "junk hop",
+			peer:    "10.0.0.1:5555",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.9, unknown, 10.1.1.1"}},
+			want:    "10.1.1.1",
+		},
+		{
+			name:    "IPv6 peer",
+			peer:    "[2001:db8::9]:5555",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.66"}},
+			want:    "2001:db8::9",
+		},
+		{
+			name:    "IPv6 in XFF",
+			peer:    "[fc00::1]:5555",
+			headers: map[string][]string{"X-Forwarded-For": {"2001:db8::9"}},
+			want:    "2001:db8::9",
+		},
+		{
+			name:    "IPv4-mapped IPv6",
+			peer:    "10.0.0.1:5555",
+			headers: map[string][]string{"X-Forwarded-For": {"::ffff:203.0.113.9"}},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "Forwarded",
+			header:  "forwarded",
+			peer:    "10.0.0.1:5555",
+			headers: map[string][]string{"Forwarded": {`for="[2001:db8::9]:4711";proto=https, for=10.1.1.1`}},
+			want:    "2001:db8::9",
+		},
+		{
+			name:   "spoofed XFF behind a Forwarded proxy",
+			header: "forwarded",
+			peer:   "10.0.0.1:5555",
+			headers: map[string][]string{
+				"Forwarded":       {"for=203.0.113.9"},
+				"X-Forwarded-For": {"198.51.100.66"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:   "Forwarded proxy without the header",
+			header: "forwarded",
+			peer:   "10.0.0.1:5555",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.66"},
+			},
+			want: "10.0.0.1",
+		},
+		{
+			name:    "Forwarded hop without for",
+			header:  "forwarded",
+			peer:    "10.0.0.1:5555",
+			headers: map[string][]string{"Forwarded": {"for=203.0.113.9, proto=https"}},
+			want:    "10.0.0.1",
+		},
+		{
+			name:   "X-Real-IP",
+			header: "x-real-ip",
+			peer:   "10.0.0.1:5555",
+			headers: map[string][]string{
+				"X-Real-Ip":       {"203.0.113.9"},
+				"X-Forwarded-For": {"198.51.100.66"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:    "X-Real-IP with a port",
+			header:  "x-real-ip",
+			peer:    "[fc00::1]:5555",
+			headers: map[string][]string{"X-Real-Ip": {"[2001:db8::9]:4711"}},
+			want:    "2001:db8::9",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := tc.header
+			if header == "" {
+				header = "x-forwarded-for"
+			}
+			p, err := newProxyResolver(trusted, header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.RemoteAddr = tc.peer
+			for k, vs := range tc.headers {
+				for _, v := range vs {
+					r.Header.Add(k, v)
+				}
+			}
+			if got := p.clientIP(r); got != tc.want {
+				t.Errorf("clientIP = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewProxyResolver(t *testing.T) {
+	if _, err := newProxyResolver("10.0.0.0/8", "X-Forwarded-For"); err != nil {
+		t.Errorf("canonical header name: %v", err)
+	}
+	if _, err := newProxyResolver("10.0.0.0/8", "x-client-ip"); err == nil {
+		t.Error("accepted an unknown header")
+	}
+	if _, err := newProxyResolver("10.0.0.0/33", "x-forwarded-for"); err == nil {
+		t.Error("accepted a bad CIDR")
+	}
+	p, err := newProxyResolver(" 10.0.0.1 , ::1", "x-forwarded-for")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.trusted) != 2 || p.trusted[0].Bits() != 32 || p.trusted[1].Bits() != 128 {
+		t.Errorf("trusted = %v, want two single hosts", p.trusted)
+	}
+}
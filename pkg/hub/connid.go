@@ -0,0 +1,83 @@
+package sockets
+
+import (
+	"errors"
+	"expvar"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Connection IDs key clientsByConnID and go into the NATS subjects of
+// everything a connection publishes, so a client that could pick another
+// tab's ID would get that tab's messages. We pick them instead:
+//
+//   - If the token has a cid claim, the API has vouched for that ID; the
+//     client's cid must match it, or be left out.
+//   - Otherwise we generate an unguessable ID, and ignore the client's cid.
+//     The exception is legacy clients, which never learn a generated ID:
+//     liwords.v1 over websockets, SSE or WebTransport. With
+//     cfg.TrustClientConnIDs set, their cid is used as is, so that old
+//     front ends keep working while they move to liwords.v2; the
+//     client-conn-id-uses counter tracks who still relies on it. JSON
+//     clients are debugging tools with nothing old to stay compatible
+//     with, so they never get their cid.
+//
+// Either way the ID goes back to liwords.v2 clients in the hello. Should two live
+// connections still end up with the same ID, the newer one replaces the
+// older if they belong to the same user, and is refused if not.
+
+var (
+	errConnIDMismatch = errors.New("connID does not match token")
+	errBadConnID      = errors.New("connID may not contain '.', '*', '>' or whitespace")
+)
+
+var clientConnIDUses = expvar.NewInt("client-conn-id-uses")
+
+// assignConnID sets the client's connection ID. The client must have logged
+// in; proposed is the cid it asked for, if any.
+func (h *Hub) assignConnID(c *Client, proposed string) error {
+	if proposed != "" && strings.ContainsAny(proposed, ".*> \t\r\n") {
+		return errBadConnID
+	}
+	switch {
+	case c.tokenConnID != "":
+		if proposed != "" && proposed != c.tokenConnID {
+			return errConnIDMismatch
+		}
+		c.connID = c.tokenConnID
+	case proposed != "" && h.cfg.TrustClientConnIDs && c.legacyConnID():
+		clientConnIDUses.Add(1)
+		c.connID = proposed
+	default:
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		c.connID = id
+	}
+	return nil
+}
+
+// legacyConnID says whether the client can only know its connection ID by
+// picking it.
+func (c *Client) legacyConnID() bool {
+	return c.protocol == protocolV1 && !c.hasCapability(CapJSON)
+}
+
+// checkDuplicateConnID is called from addClient. It returns false if the
+// client must be refused.
+func (h *Hub) checkDuplicateConnID(c *Client) bool {
+	old, ok := h.clientsByConnID[c.connID]
+	if !ok {
+		return true
+	}
+	if old.userID != c.userID {
+		log.Warn().Str("connID", c.connID).Str("userID", c.userID).
+			Str("existing-userID", old.userID).Msg("duplicate-connid-refused")
+		return false
+	}
+	log.Info().Str("connID", c.connID).Str("username", c.username).Msg("duplicate-connid-replaced")
+	h.closeClient(old, closeReplaced, "replaced by a newer connection")
+	return true
+}
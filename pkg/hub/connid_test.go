@@ -0,0 +1,69 @@
+package sockets
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnIDFromClient(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		protocol string
+		trust    bool
+		want     bool
+	}{
+		// liwords.v2 clients are told their ID, so never get to pick it.
+		{"v2", protocolV2, false, false},
+		{"v2 while trusting", protocolV2, true, false},
+		{"v1", protocolV1, false, false},
+		{"v1 while trusting", protocolV1, true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := []string{}
+			if tc.trust {
+				args = append(args, "-trust-client-conn-ids")
+			}
+			h := newTestHub(t, newTestNats(t), args...)
+			url := serveTestWS(t, h) + "/ws?path=/&cid=mine"
+			d := websocket.Dialer{Subprotocols: []string{
+				tc.protocol, tokenProtocolPrefix + newTestToken(t, "u1", nil)}}
+			ws, _, err := d.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+
+			connID := waitForConns(t, h, 1)[0].ConnID
+			if got := connID == "mine"; got != tc.want {
+				t.Errorf("connID = %q; client's cid used: %v, want %v", connID, got, tc.want)
+			}
+			if tc.protocol != protocolV2 {
+				return
+			}
+			var hello helloMessage
+			if err := ws.ReadJSON(&hello); err != nil {
+				t.Fatal(err)
+			}
+			if hello.Type != "hello" || hello.ConnID != connID {
+				t.Errorf("hello = %+v, want one with connID %q", hello, connID)
+			}
+		})
+	}
+}
+
+func TestAssignConnIDJSONClient(t *testing.T) {
+	h := newTestHub(t, newTestNats(t), "-trust-client-conn-ids")
+	c := newTestClient(h, "u1", "")
+	c.protocol = protocolV1
+	c.capabilities = CapJSON
+	if err := h.assignConnID(c, "mine"); err != nil {
+		t.Fatal(err)
+	}
+	if c.connID == "mine" {
+		t.Error("a JSON client picked its own connID")
+	}
+	if len(c.connID) < 20 {
+		t.Errorf("connID %q looks guessable", c.connID)
+	}
+}
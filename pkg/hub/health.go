@@ -0,0 +1,108 @@
+package sockets
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// /healthz says whether the process works at all: it is unhealthy if Run
+// doesn't answer a ping within eventLoopTimeout, since a wedged event loop
+// never recovers and the pod should be restarted. /readyz says whether we
+// should be sent new connections: NATS must be connected with every
+// subscription in place, the node must not be draining and it must be
+// under its connection cap. Both answer 200 or 503 with the details as JSON.
+
+const eventLoopTimeout = 2 * time.Second
+
+var errEventLoopStuck = errors.New("event loop did not respond in time")
+
+type healthStatus struct {
+	OK          bool   `json:"ok"`
+	EventLoopMs int64  `json:"eventLoopMs"`
+	Error       string `json:"error,omitempty"`
+}
+
+type readyStatus struct {
+	OK                bool     `json:"ok"`
+	NatsStatus        string   `json:"natsStatus"`
+	Subscriptions     int      `json:"subscriptions"`
+	InvalidSubs       []string `json:"invalidSubscriptions,omitempty"`
+	Draining          bool     `json:"draining"`
+	Conns             int      `json:"conns"`
+	MaxConns          int      `json:"maxConns"`
+	AtConnectionLimit bool     `json:"atConnectionLimit"`
+}
+
+// pingEventLoop returns how long Run took to answer, or an error if it
+// didn't answer in time.
+func (h *Hub) pingEventLoop() (time.Duration, error) {
+	start := time.Now()
+	reply := make(chan struct{})
+	timer := time.NewTimer(eventLoopTimeout)
+	defer timer.Stop()
+	select {
+	case h.ping <- reply:
+	case <-timer.C:
+		return time.Since(start), errEventLoopStuck
+	}
+	select {
+	case <-reply:
+		return time.Since(start), nil
+	case <-timer.C:
+		return time.Since(start), errEventLoopStuck
+	}
+}
+
+// Drain marks the node as going away, so /readyz fails and no more
+// connections get routed here.
+func (h *Hub) Drain() {
+	h.draining.Store(true)
+}
+
+func writeStatus(w http.ResponseWriter, ok bool, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Err(err).Msg("health-write-json")
+	}
+}
+
+// ServeHealthz handles liveness checks.
+func ServeHealthz(h *Hub, w http.ResponseWriter, r *http.Request) {
+	took, err := h.pingEventLoop()
+	status := healthStatus{OK: err == nil, EventLoopMs: took.Milliseconds()}
+	if err != nil {
+		status.Error = err.Error()
+		log.Error().Int64("waited-ms", status.EventLoopMs).Msg("event-loop-unresponsive")
+	}
+	writeStatus(w, status.OK, status)
+}
+
+// ServeReadyz handles readiness checks.
+func ServeReadyz(h *Hub, w http.ResponseWriter, r *http.Request) {
+	nc := h.pubsub.natsconn
+	status := readyStatus{
+		NatsStatus:    nc.Status().String(),
+		Subscriptions: len(h.pubsub.subscriptions),
+		Draining:      h.draining.Load(),
+		MaxConns:      h.cfg.MaxConns,
+	}
+	for _, sub := range h.pubsub.subscriptions {
+		if !sub.IsValid() {
+			status.InvalidSubs = append(status.InvalidSubs, sub.Subject)
+		}
+	}
+	status.Conns, status.AtConnectionLimit = h.limiter.usage()
+	status.OK = nc.IsConnected() && len(status.InvalidSubs) == 0 &&
+		!status.Draining && !status.AtConnectionLimit
+	writeStatus(w, status.OK, status)
+}
@@ -1,20 +1,30 @@
 package sockets
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	nats "github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/proto"
 
 	pb "github.com/woogles-io/liwords/rpc/api/proto/ipc"
 
+	"github.com/woogles-io/liwords-socket/pkg/audit"
 	"github.com/woogles-io/liwords-socket/pkg/config"
+	"github.com/woogles-io/liwords-socket/pkg/tracing"
 )
 
 // A Realm is basically a set of clients. It can be thought of as a game room,
@@ -26,8 +36,20 @@ const LobbyRealm Realm = "lobby"
 
 const ConnPollPeriod = 60 * time.Second
 
+var tracer = otel.Tracer("github.com/woogles-io/liwords-socket/pkg/hub")
+
+// endSpan ends the span, marking it as failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
 // A RealmMessage is a message that should be sent to a socket Realm.
 type RealmMessage struct {
+	ctx   context.Context
 	realm Realm
 	msg   []byte
 }
@@ -35,6 +57,7 @@ type RealmMessage struct {
 // A UserMessage is a message that should be sent to a user (across all
 // of the sockets that they are connected to, unless the channel says otherwise).
 type UserMessage struct {
+	ctx     context.Context
 	userID  string
 	channel string
 	msg     []byte
@@ -42,6 +65,7 @@ type UserMessage struct {
 
 // A ConnMessage is a message that just gets sent to a single socket connection.
 type ConnMessage struct {
+	ctx    context.Context
 	connID string
 	msg    []byte
 }
@@ -49,6 +73,8 @@ type ConnMessage struct {
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
+	cfg *config.Config
+
 	// Registered clients.
 	clients         map[*Client][]Realm
 	clientsByUserID map[string]map[*Client]bool
@@ -71,30 +97,175 @@ type Hub struct {
 	broadcastRealm  chan RealmMessage
 	broadcastUser   chan UserMessage
 	sendConnMessage chan ConnMessage
+	broadcastNotice chan noticeMessage
+
+	// Requests from the admin API.
+	inspect chan inspectRequest
+	kick    chan kickRequest
+
+	// Liveness pings; Run closes each channel it receives. See health.go.
+	ping     chan chan struct{}
+	draining atomic.Bool
+
+	// NATS connection state changes; see natsstate.go. natsDown belongs
+	// to Run.
+	natsUp   chan bool
+	natsDown bool
+
+	// recentConnects are when each user disconnected and reconnected
+	// lately, for connection quality; see quality.go. It belongs to Run.
+	recentConnects map[string]*connHistory
+
+	sseMutex sync.Mutex
+	// SSE clients by session ID, so that upstream POSTs can find them.
+	sseSessions map[string]*Client
+
+	audit   *audit.Logger
+	proxies *proxyResolver
+	limiter *connLimiter
+	bans    *banList
+	// realmCache remembers registerRealm responses; see realmcache.go.
+	realmCache *realmCache
+	// New bans, so the hub can close matching sockets.
+	enforceBans chan banEnforcement
 }
 
 func NewHub(cfg *config.Config) (*Hub, error) {
-	pubsub, err := newPubSub(cfg.NatsURL)
+	natsOpts, err := natsOptions(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("nats options: %w", err)
+	}
+	pubsub, err := newPubSub(cfg.NatsURL, cfg.NatsSubjectPrefix, natsOpts...)
+	if err != nil {
+		return nil, err
+	}
+	var publishProbes []string
+	if cfg.NatsCheckPublish {
+		publishProbes = permissionProbes(cfg.AuditSubject)
+	}
+	if err := pubsub.checkPermissions(publishProbes); err != nil {
+		pubsub.natsconn.Close()
+		return nil, err
+	}
+
+	proxies, err := newProxyResolver(cfg.TrustedProxies, cfg.ClientIPHeader)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+
+	bans, err := newBanList(cfg.BanFile)
+	if err != nil {
+		return nil, fmt.Errorf("ban list: %w", err)
+	}
+
+	auditSubject := ""
+	if cfg.AuditSubject != "" {
+		auditSubject = pubsub.subject(cfg.AuditSubject)
+	}
+	auditLog, err := audit.New(audit.Options{
+		Subject:       auditSubject,
+		Publisher:     pubsub.natsconn,
+		Dir:           cfg.AuditDir,
+		MaxFileBytes:  int64(cfg.AuditMaxFileMB) << 20,
+		RetentionDays: cfg.AuditRetentionDays,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &Hub{
+	h := &Hub{
+		cfg: cfg,
 		// broadcast:         make(chan []byte),
 		broadcastRealm:  make(chan RealmMessage),
 		broadcastUser:   make(chan UserMessage),
 		sendConnMessage: make(chan ConnMessage),
+		broadcastNotice: make(chan noticeMessage),
 		register:        make(chan *Client),
 		unregister:      make(chan *Client),
+		inspect:         make(chan inspectRequest),
+		kick:            make(chan kickRequest),
+		ping:            make(chan chan struct{}),
+		natsUp:          make(chan bool),
+		enforceBans:     make(chan banEnforcement),
 		clients:         make(map[*Client][]Realm),
 		clientsByUserID: make(map[string]map[*Client]bool),
 		clientsByConnID: make(map[string]*Client),
 		realms:          make(map[Realm]map[*Client]bool),
+		sseSessions:     make(map[string]*Client),
+		recentConnects:  make(map[string]*connHistory),
 		pubsub:          pubsub,
-	}, nil
+		audit:           auditLog,
+		proxies:         proxies,
+		limiter:         newConnLimiter(cfg.MaxConns, cfg.MaxConnsPerUser, cfg.MaxConnsPerAnonIP),
+		bans:            bans,
+		realmCache:      newRealmCache(cfg.RealmCacheTTL),
+	}
+	h.watchNats(pubsub.natsconn)
+	return h, nil
+}
+
+// Close flushes the audit log. Call it once the servers have shut down.
+func (h *Hub) Close() error {
+	return h.audit.Close()
+}
+
+// auditEvent returns an audit event of the given type for the client.
+func (c *Client) auditEvent(typ string) audit.Event {
+	return audit.Event{
+		Type:          typ,
+		ConnID:        c.connID,
+		UserID:        c.userID,
+		Username:      c.username,
+		Authenticated: c.authenticated,
+		IP:            c.ip,
+		Transport:     c.transport,
+	}
 }
 
 func (h *Hub) addClient(client *Client) error {
+	// A ban may have come in while the client was registering; closeBanned
+	// only sees registered clients.
+	if client.currentState() == statePending && h.bans.banned(client) {
+		evt := client.auditEvent(audit.Ban)
+		evt.Reason = "banned"
+		h.audit.Log(evt)
+		h.dropPending(client, closeBanned, "banned")
+		return errors.New("banned while registering")
+	}
+	if client.currentState() == statePending && !h.checkDuplicateConnID(client) {
+		h.dropPending(client, closeDuplicateConnID, "connID in use")
+		return errors.New("duplicate connID")
+	}
+	if client.currentState() != statePending {
+		// It went away before we got to it.
+		return errors.New("client is no longer pending")
+	}
+	// Subscribe before registering, so that a client we can't get messages
+	// to is turned away rather than left waiting for them.
+	realms := make([]Realm, len(client.tempRealms))
+	for i, realm := range client.tempRealms {
+		realms[i] = Realm(realm)
+	}
+	subjects := clientSubjects(client, realms)
+	if err := h.pubsub.wantAll(subjects); err != nil {
+		log.Err(err).Str("connid", client.connID).Msg("interest-subscribe")
+		h.dropPending(client, closeTryAgainLater, "can't subscribe; try again later")
+		return err
+	}
+	registered := client.register(func(m heldMessage) {
+		if client.degraded.Load() {
+			return
+		}
+		if err := h.publishMessage(m.ctx, client, m.msg, m.received); err != nil {
+			log.Err(err).Str("connid", client.connID).Msg("publish-held-message")
+		}
+	})
+	if !registered {
+		// It went away while we subscribed; Run is the only one who could
+		// have dropped it, so this can't happen, but don't leak the refs.
+		h.pubsub.unwantAll(subjects)
+		return errors.New("client is no longer pending")
+	}
 
 	// Add client to appropriate maps
 	byUser := h.clientsByUserID[client.userID]
@@ -104,6 +275,10 @@ func (h *Hub) addClient(client *Client) error {
 	// Add the new user ID to the map.
 	h.clientsByUserID[client.userID][client] = true
 	h.clientsByConnID[client.connID] = client
+	h.countReconnect(client)
+	evt := client.auditEvent(audit.Connect)
+	evt.Realms = client.tempRealms
+	h.audit.Log(evt)
 	// add to the realm map.
 	h.addToRealm(client.tempRealms, client)
 	client.tempRealms = []string{}
@@ -120,12 +295,42 @@ func (h *Hub) addClient(client *Client) error {
 }
 
 func (h *Hub) removeClient(c *Client) error {
+	return h.closeClient(c, 0, "")
+}
+
+// closeClient removes the client from the hub, telling the peer why. It does
+// nothing if the client is already closing.
+func (h *Hub) closeClient(c *Client, code closeCode, reason string) error {
+	if !c.beginClose(code, reason) {
+		return nil
+	}
+	defer c.finishClose()
 	// no need to protect with mutex, only called from
 	// single-threaded Run
 	log.Debug().Str("client", c.username).Str("connid", c.connID).Str("userid", c.userID).Msg("removing client")
-	close(c.send)
+	h.limiter.release(c)
+
+	evt := c.auditEvent(audit.Disconnect)
+	evt.Realms = make([]string, len(c.realms))
+	for i, r := range c.realms {
+		evt.Realms[i] = string(r)
+	}
+	evt.Reason = c.closeReason
+	evt.DurationMs = time.Since(c.connectedAt).Milliseconds()
+	h.audit.Log(evt)
+
+	// A last quality report, so the backend knows how the connection
+	// fared right up to the end.
+	c.RLock()
+	q, pinged := c.quality(), c.pingsSent > 0
+	c.RUnlock()
+	if pinged {
+		h.publishQuality(c, q)
+	}
+	h.countDisconnect(c)
 
 	realms := h.clients[c]
+	h.pubsub.unwantAll(clientSubjects(c, realms))
 
 	for _, realm := range realms {
 		delete(h.realms[realm], c)
@@ -146,7 +351,7 @@ func (h *Hub) removeClient(c *Client) error {
 	// pass in a conn ID of some sort. We would associate outgoing
 	// seek / match requests with a conn ID.
 
-	h.pubsub.natsconn.Publish(extendTopic(c, "ipc.pb.leaveTab"), []byte{})
+	h.pubsub.publish(extendTopic(c, "ipc.pb.leaveTab"), []byte{})
 
 	if (len(h.clientsByUserID[c.userID])) == 1 {
 		delete(h.clientsByUserID, c.userID)
@@ -156,7 +361,7 @@ func (h *Hub) removeClient(c *Client) error {
 		// Tell the backend that this user has left the site. The backend
 		// can then do things (cancel seek requests, inform players their
 		// opponent has left, etc).
-		h.pubsub.natsconn.Publish(extendTopic(c, "ipc.pb.leaveSite"), []byte{})
+		h.pubsub.publish(extendTopic(c, "ipc.pb.leaveSite"), []byte{})
 		return nil
 	}
 	// Otherwise, delete just the right socket (this one: c)
@@ -167,23 +372,38 @@ func (h *Hub) removeClient(c *Client) error {
 	return nil
 }
 
-func (h *Hub) sendToRealm(realm Realm, msg []byte) error {
-	h.broadcastRealm <- RealmMessage{realm: realm, msg: msg}
+// dropPending closes a client that the hub never added. It returns false if
+// the client wasn't pending.
+func (h *Hub) dropPending(c *Client, code closeCode, reason string) bool {
+	if c.currentState() != statePending || !c.beginClose(code, reason) {
+		return false
+	}
+	c.finishClose()
+	h.limiter.release(c)
+	evt := c.auditEvent(audit.Disconnect)
+	evt.Reason = reason
+	evt.DurationMs = time.Since(c.connectedAt).Milliseconds()
+	h.audit.Log(evt)
+	return true
+}
+
+func (h *Hub) sendToRealm(ctx context.Context, realm Realm, msg []byte) error {
+	h.broadcastRealm <- RealmMessage{ctx: ctx, realm: realm, msg: msg}
 	return nil
 }
 
-func (h *Hub) sendToConnID(connID string, msg []byte) error {
-	h.sendConnMessage <- ConnMessage{connID: connID, msg: msg}
+func (h *Hub) sendToConnID(ctx context.Context, connID string, msg []byte) error {
+	h.sendConnMessage <- ConnMessage{ctx: ctx, connID: connID, msg: msg}
 	return nil
 }
 
-func (h *Hub) sendToUser(userID string, msg []byte) error {
-	h.broadcastUser <- UserMessage{userID: userID, msg: msg}
+func (h *Hub) sendToUser(ctx context.Context, userID string, msg []byte) error {
+	h.broadcastUser <- UserMessage{ctx: ctx, userID: userID, msg: msg}
 	return nil
 }
 
-func (h *Hub) sendToUserChannel(userID string, msg []byte, channel string) error {
-	h.broadcastUser <- UserMessage{userID: userID, msg: msg, channel: channel}
+func (h *Hub) sendToUserChannel(ctx context.Context, userID string, msg []byte, channel string) error {
+	h.broadcastUser <- UserMessage{ctx: ctx, userID: userID, msg: msg, channel: channel}
 	return nil
 }
 
@@ -217,6 +437,10 @@ func (h *Hub) Run() {
 					log.Err(err).Msg("error-removing-client")
 				}
 				log.Info().Str("username", client.username).Msg("unregistered-client")
+			} else if h.dropPending(client, 0, "left before registering") {
+				// It went away before we added it; the register
+				// request, when it comes, will be refused.
+				log.Info().Str("username", client.username).Msg("unregistered-pending-client")
 			} else {
 				log.Error().Msg("unregistered-but-not-in-map")
 			}
@@ -226,21 +450,35 @@ func (h *Hub) Run() {
 			log.Debug().Str("realm", string(message.realm)).
 				Int("clients", len(h.realms[message.realm])).
 				Msg("sending broadcast message to realm")
+			_, span := tracer.Start(message.ctx, "fanout", trace.WithAttributes(
+				attribute.String("realm", string(message.realm)),
+				attribute.Int("clients", len(h.realms[message.realm]))))
+			frame := outboundFrame{data: message.msg}
+			if len(h.realms[message.realm]) > 1 {
+				// Encode the frame once and share it across every socket
+				// in the realm.
+				pm, err := websocket.NewPreparedMessage(websocket.BinaryMessage, message.msg)
+				if err != nil {
+					log.Err(err).Str("realm", string(message.realm)).Msg("preparing-broadcast")
+				} else {
+					frame.prepared = pm
+				}
+			}
 			for client := range h.realms[message.realm] {
 				select {
-				// XXX: got a panic: send on closed channel from this line:
-				// I think this is because the client wasn't done registering
-				// (register-realm-path) before it was disconnected abnormally.
-				case client.send <- message.msg:
+				case client.send <- frame:
 				default:
 					log.Debug().Str("username", client.username).Msg("in broadcastRealm, removeClient")
-					h.removeClient(client)
+					h.closeClient(client, closeTooSlow, "too slow")
 				}
 			}
+			span.End()
 
 		case message := <-h.broadcastUser:
 			log.Debug().Str("user", string(message.userID)).
 				Msg("sending to all user sockets")
+			_, span := tracer.Start(message.ctx, "fanout", trace.WithAttributes(
+				attribute.Int("clients", len(h.clientsByUserID[message.userID]))))
 			// Send the message to every socket belonging to this user.
 			for client := range h.clientsByUserID[message.userID] {
 				canSend := true
@@ -260,12 +498,13 @@ func (h *Hub) Run() {
 					continue
 				}
 				select {
-				case client.send <- message.msg:
+				case client.send <- outboundFrame{data: message.msg}:
 				default:
 					log.Debug().Str("username", client.username).Msg("in broadcastUser, removeClient")
-					h.removeClient(client)
+					h.closeClient(client, closeTooSlow, "too slow")
 				}
 			}
+			span.End()
 
 		case message := <-h.sendConnMessage:
 			c, ok := h.clientsByConnID[message.connID]
@@ -274,14 +513,34 @@ func (h *Hub) Run() {
 				log.Debug().Str("connID", message.connID).Msg("connID-not-found")
 			} else {
 				select {
-				case c.send <- message.msg:
+				case c.send <- outboundFrame{data: message.msg}:
+					trace.SpanFromContext(message.ctx).AddEvent("queued")
 				default:
 					log.Debug().Str("connID", message.connID).Msg("in sendToConnID, removeClient")
-					h.removeClient(c)
+					h.closeClient(c, closeTooSlow, "too slow")
 				}
 			}
 
+		case message := <-h.broadcastNotice:
+			h.deliverNotice(message)
+
+		case req := <-h.inspect:
+			h.inspectConns(req)
+
+		case req := <-h.kick:
+			h.kickConns(req)
+
+		case e := <-h.enforceBans:
+			h.closeBanned(e)
+
+		case reply := <-h.ping:
+			close(reply)
+
+		case up := <-h.natsUp:
+			h.natsStateChanged(up)
+
 		case <-ticker.C:
+			h.pruneRecentConnects()
 			log.Info().Int("num-conns", len(h.clients)).
 				Int("num-users", len(h.clientsByUserID)).
 				Int("num-realms", len(h.realms)).Msg("conn-stats")
@@ -303,11 +562,23 @@ func (h *Hub) addToRealm(realms []string, client *Client) {
 		client.realms = append(client.realms, realm)
 		h.realms[realm][client] = true
 		h.clients[client] = append(h.clients[client], realm)
+		evt := client.auditEvent(audit.RealmJoin)
+		evt.Realms = []string{string(realm)}
+		h.audit.Log(evt)
 	}
 
 }
 
-func (h *Hub) socketLogin(c *Client) error {
+func (h *Hub) socketLogin(c *Client) (err error) {
+	defer func() {
+		if err != nil {
+			log.Err(err).Str("token", redactToken(c.connToken)).Str("transport", c.transport).
+				Msg("socket-login-failure")
+			evt := c.auditEvent(audit.LoginFail)
+			evt.Reason = err.Error()
+			h.audit.Log(evt)
+		}
+	}()
 
 	token, err := jwt.Parse(c.connToken, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
@@ -318,32 +589,46 @@ func (h *Hub) socketLogin(c *Client) error {
 		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
 		return []byte(os.Getenv("SECRET_KEY")), nil
 	})
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-
-		c.authenticated, ok = claims["a"].(bool)
-		if !ok {
-			return errors.New("malformed token - a")
-		}
-		c.username, ok = claims["unn"].(string)
-		if !ok {
-			return errors.New("malformed token - unn")
-		}
-
-		c.userID = claims["uid"].(string)
-		log.Debug().Str("username", c.username).Str("userID", c.userID).
-			Bool("auth", c.authenticated).Msg("socket connection")
-	}
 	if err != nil {
-		log.Err(err).Str("token", c.connToken).Msg("socket-login-failure")
+		// token may be nil here.
+		return err
 	}
-	if !token.Valid {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
 		return errors.New("invalid token")
 	}
-	return err
+
+	c.authenticated, ok = claims["a"].(bool)
+	if !ok {
+		return errors.New("malformed token - a")
+	}
+	c.username, ok = claims["unn"].(string)
+	if !ok {
+		return errors.New("malformed token - unn")
+	}
+	c.userID, ok = claims["uid"].(string)
+	if !ok {
+		return errors.New("malformed token - uid")
+	}
+	// Tokens may be issued for a particular connection; see connid.go.
+	if cid, ok := claims["cid"].(string); ok {
+		c.tokenConnID = cid
+	}
+	// Older tokens may not have any perms.
+	if perms, ok := claims["perms"].(string); ok && perms != "" {
+		c.perms = strings.Split(perms, ",")
+	}
+	log.Debug().Str("username", c.username).Str("userID", c.userID).
+		Bool("auth", c.authenticated).Msg("socket connection")
+	return nil
 }
 
-// Note: This is a BLOCKING call -- see natsconn.Request below.
-func registerRealm(c *Client, path string, h *Hub) error {
+// Note: This is a BLOCKING call -- see natsconn.Request below. ctx must
+// have a deadline; see registerAsync.
+func registerRealm(ctx context.Context, c *Client, path string, h *Hub) (err error) {
+	ctx, span := tracer.Start(ctx, "registerRealm", trace.WithAttributes(attribute.String("path", path)))
+	defer func() { endSpan(span, err) }()
+
 	// There are a variety of possible realms that a person joining a game
 	// can be in. We should not trust the user to send the right realm
 	// (for example they can send a TV mode realm if they're a player
@@ -355,7 +640,11 @@ func registerRealm(c *Client, path string, h *Hub) error {
 	if path == "/" {
 		// This is the lobby; no need to request a realm.
 		realms = []string{string(LobbyRealm), "chat-" + string(LobbyRealm)}
+	} else if cached, ok := h.realmCache.get(path, c.userID); ok {
+		span.SetAttributes(attribute.Bool("realm.cached", true))
+		realms = cached
 	} else {
+		gen := h.realmCache.generation()
 		// First, create a request and send to the IPC api:
 		rrr := &pb.RegisterRealmRequest{}
 		rrr.Path = path
@@ -364,7 +653,10 @@ func registerRealm(c *Client, path string, h *Hub) error {
 		if err != nil {
 			return err
 		}
-		resp, err := h.pubsub.natsconn.Request("ipc.request.registerRealm", data, ipcTimeout)
+		req := nats.NewMsg(h.pubsub.subject("ipc.request.registerRealm"))
+		req.Data = data
+		tracing.Inject(ctx, req)
+		resp, err := h.pubsub.natsconn.RequestMsgWithContext(ctx, req)
 		if err != nil {
 			log.Err(err).Msg("timeout registering realm")
 			return err
@@ -377,6 +669,7 @@ func registerRealm(c *Client, path string, h *Hub) error {
 			return err
 		}
 		realms = rrResp.Realms
+		h.realmCache.put(path, c.userID, realms, gen)
 	}
 	log.Debug().Interface("realms", realms).Msg("setting-realms")
 
@@ -405,6 +698,6 @@ func (h *Hub) sendRealmInitInfo(c *Client) error {
 
 	log.Debug().Interface("initRealmInfo", req).Msg("req-init-realm-info")
 
-	return h.pubsub.natsconn.Publish(extendTopic(c, "ipc.pb.initRealmInfo"), data)
+	return h.pubsub.publish(extendTopic(c, "ipc.pb.initRealmInfo"), data)
 
 }
@@ -0,0 +1,129 @@
+package sockets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nats-io/nats-server/v2/server"
+	natstest "github.com/nats-io/nats-server/v2/test"
+
+	"github.com/woogles-io/liwords-socket/pkg/config"
+)
+
+// newTestNats starts a NATS server for the test on a free port.
+func newTestNats(t testing.TB) *server.Server {
+	t.Helper()
+	opts := natstest.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	ns := natstest.RunServer(&opts)
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+// newTestHub returns a hub connected to ns, with the given extra flags.
+// Run is not started.
+func newTestHub(t testing.TB, ns *server.Server, args ...string) *Hub {
+	t.Helper()
+	cfg := &config.Config{}
+	if err := cfg.Load(append([]string{"-nats-url", ns.ClientURL()}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHub(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.pubsub.natsconn.Close() })
+	return h
+}
+
+// newTestClient returns a pending client that wants to join realms.
+func newTestClient(h *Hub, userID, connID string, realms ...string) *Client {
+	return &Client{
+		hub:           h,
+		transport:     transportWebsocket,
+		send:          make(chan outboundFrame, 256),
+		userID:        userID,
+		username:      userID,
+		connID:        connID,
+		authenticated: true,
+		tempRealms:    realms,
+		connectedAt:   time.Now(),
+	}
+}
+
+// connCount asks a running hub how many clients it has.
+func connCount(h *Hub) int {
+	return len(conns(h))
+}
+
+// conns asks a running hub about its clients.
+func conns(h *Hub) []ConnInfo {
+	reply := make(chan []ConnInfo, 1)
+	h.inspect <- inspectRequest{realm: NullRealm, reply: reply}
+	return <-reply
+}
+
+// waitForConns waits for a running hub to have n clients.
+func waitForConns(t testing.TB, h *Hub, n int) []ConnInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		infos := conns(h)
+		if len(infos) == n {
+			return infos
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hub has %d clients, want %d", len(infos), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+const testSecretKey = "test-secret-key"
+
+// newTestToken returns a token for the user, signed with the key that
+// socketLogin will check it against. extra claims are added to it.
+func newTestToken(t testing.TB, userID string, extra jwt.MapClaims) string {
+	t.Helper()
+	t.Setenv("SECRET_KEY", testSecretKey)
+	claims := jwt.MapClaims{"a": true, "unn": userID, "uid": userID}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecretKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// serveTestWS starts Run and an HTTP server for the hub's websockets, and
+// returns the ws:// URL to dial.
+func serveTestWS(t testing.TB, h *Hub) string {
+	t.Helper()
+	go h.Run()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWS(h, w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// drained says whether the client's send channel has been closed, reading
+// whatever is still queued.
+func drained(c *Client) bool {
+	for {
+		select {
+		case _, ok := <-c.send:
+			if !ok {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
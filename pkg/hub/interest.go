@@ -0,0 +1,141 @@
+package sockets
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+// A node only subscribes to what its own clients want: game.<id> while
+// someone here is in the game's realm, user.<id> while the user has a
+// connection here, and so on, rather than to game.> and friends. That way
+// each node handles traffic in proportion to its own clients, not to the
+// whole site. For each subject we subscribe to both <subject> and
+// <subject>.>, since publishers add sub-topics to some of them.
+//
+// Subscriptions are counted: each registered client holds a reference to
+// each of its subjects, taken in addClient and dropped in closeClient, and
+// we unsubscribe when the last reference goes. NATS processes our
+// subscriptions in order with our publishes, so as long as we subscribe
+// before asking the API for a realm's initial state, we won't miss it.
+
+// interestKinds are the first tokens of the subjects we subscribe to by
+// interest.
+var interestKinds = []string{
+	"lobby", "game", "gametv", "tournament", "usertv", "channel", "chat", "user", "connid",
+}
+
+var interestSubjects = expvar.NewInt("nats-interest-subjects")
+
+type interestSub struct {
+	refs int
+	subs []*nats.Subscription
+}
+
+// want subscribes to the subject if nobody wanted it yet. If the subscribe
+// fails, nothing is recorded and the caller must not unwant the subject. It
+// must only be called from Run.
+func (ps *PubSub) want(subject string) error {
+	if subject == "" {
+		return nil
+	}
+	if is, ok := ps.interests[subject]; ok {
+		is.refs++
+		return nil
+	}
+	is := &interestSub{refs: 1}
+	for _, s := range []string{subject, subject + ".>"} {
+		sub, err := ps.natsconn.ChanSubscribe(ps.subject(s), ps.msgs)
+		if err != nil {
+			for _, sub := range is.subs {
+				sub.Unsubscribe()
+			}
+			return fmt.Errorf("subscribing to %s: %w", s, err)
+		}
+		is.subs = append(is.subs, sub)
+	}
+	ps.interests[subject] = is
+	interestSubjects.Set(int64(len(ps.interests)))
+	return nil
+}
+
+// wantAll wants every one of the subjects, or, if one fails, none of them.
+func (ps *PubSub) wantAll(subjects []string) error {
+	for i, subject := range subjects {
+		if err := ps.want(subject); err != nil {
+			ps.unwantAll(subjects[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *PubSub) unwantAll(subjects []string) {
+	for _, subject := range subjects {
+		ps.unwant(subject)
+	}
+}
+
+// unwant unsubscribes from the subject once nobody wants it. It must only
+// be called from Run.
+func (ps *PubSub) unwant(subject string) {
+	is, ok := ps.interests[subject]
+	if !ok {
+		return
+	}
+	if is.refs--; is.refs > 0 {
+		return
+	}
+	for _, sub := range is.subs {
+		if err := sub.Unsubscribe(); err != nil {
+			log.Err(err).Str("subject", sub.Subject).Msg("interest-unsubscribe")
+		}
+	}
+	delete(ps.interests, subject)
+	interestSubjects.Set(int64(len(ps.interests)))
+}
+
+// realmSubject returns the subject that carries messages for the realm; see
+// routeMessage for the other direction. It returns "" for realms that no
+// subject maps to.
+func realmSubject(realm Realm) string {
+	if realm == LobbyRealm {
+		return "lobby"
+	}
+	if strings.HasPrefix(string(realm), "chat-") {
+		// chat.pm.> is always subscribed; don't get those twice.
+		if strings.HasPrefix(string(realm), "chat-pm-") {
+			return ""
+		}
+		return realmToChannel(realm)
+	}
+	kind, id, ok := strings.Cut(string(realm), "-")
+	if !ok || id == "" {
+		return ""
+	}
+	switch kind {
+	case "game", "gametv", "tournament", "usertv", "channel":
+		return kind + "." + id
+	}
+	return ""
+}
+
+// clientSubjects returns the subjects a client in the realms needs.
+func clientSubjects(c *Client, realms []Realm) []string {
+	subjects := []string{userSubject(c.userID), connIDSubject(c.connID)}
+	for _, realm := range realms {
+		subjects = append(subjects, realmSubject(realm))
+	}
+	return subjects
+}
+
+func userSubject(userID string) string {
+	return "user." + userID
+}
+
+func connIDSubject(connID string) string {
+	return "connid." + connID
+}
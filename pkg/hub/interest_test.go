@@ -0,0 +1,133 @@
+package sockets
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+func TestInterestRefs(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	a := newTestClient(h, "u1", "c1", "game-g1")
+	b := newTestClient(h, "u2", "c2", "game-g1")
+
+	for _, c := range []*Client{a, b} {
+		if err := h.addClient(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if is := h.pubsub.interests["game.g1"]; is == nil || is.refs != 2 {
+		t.Fatalf("game.g1 interest = %+v, want 2 refs", is)
+	}
+
+	h.removeClient(a)
+	if h.pubsub.interests["game.g1"] == nil {
+		t.Fatal("game.g1 was dropped while b is still in it")
+	}
+	if h.pubsub.interests["user.u1"] != nil || h.pubsub.interests["connid.c1"] != nil {
+		t.Error("a's own subjects are still subscribed")
+	}
+
+	h.removeClient(b)
+	if n := len(h.pubsub.interests); n != 0 {
+		t.Errorf("%d interests left, want 0: %v", n, h.pubsub.interests)
+	}
+}
+
+func TestAddClientSubscribeFails(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	h.pubsub.natsconn.Close()
+	c := newTestClient(h, "u1", "c1", "game-g1")
+
+	if err := h.addClient(c); err == nil {
+		t.Fatal("addClient registered a client it couldn't subscribe for")
+	}
+	if got := c.currentState(); got != stateClosed {
+		t.Errorf("state = %v, want closed", got)
+	}
+	if c.closeCode != closeTryAgainLater {
+		t.Errorf("closeCode = %d, want %d", c.closeCode, closeTryAgainLater)
+	}
+	if _, ok := h.clients[c]; ok {
+		t.Error("client is in clients")
+	}
+	if n := len(h.pubsub.interests); n != 0 {
+		t.Errorf("%d interests recorded, want 0: %v", n, h.pubsub.interests)
+	}
+}
+
+// BenchmarkNodeTraffic measures what one node receives while the rest of
+// the site is busy: game messages spread over many games, only one of
+// which has a client on this node. With interest subscriptions the node
+// should see only that game's share; subscribed to game.>, it sees all of
+// it.
+func BenchmarkNodeTraffic(b *testing.B) {
+	const games = 1000
+	data := []byte("move")
+
+	for _, firehose := range []bool{false, true} {
+		b.Run(fmt.Sprintf("firehose=%v", firehose), func(b *testing.B) {
+			ns := newTestNats(b)
+			h := newTestHub(b, ns)
+			// want belongs to Run, so this must happen before it starts.
+			if firehose {
+				if err := h.pubsub.want("game"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			go h.Run()
+
+			c := newTestClient(h, "u1", "c1", "game-g0")
+			go func() {
+				for range c.send {
+				}
+			}()
+			h.register <- c
+
+			pub, err := nats.Connect(ns.ClientURL())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer pub.Close()
+			// Wait for our subscriptions to reach the server.
+			if err := h.pubsub.natsconn.Flush(); err != nil {
+				b.Fatal(err)
+			}
+
+			// Publish one message per game, then wait for the node to take
+			// its share, so the firehose doesn't just overrun it.
+			start := h.pubsub.natsconn.Stats().InMsgs
+			var want uint64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				game := i % games
+				if err := pub.Publish(fmt.Sprintf("game.g%d", game), data); err != nil {
+					b.Fatal(err)
+				}
+				if firehose || game == 0 {
+					want++
+				}
+				if game != games-1 && i != b.N-1 {
+					continue
+				}
+				if err := pub.Flush(); err != nil {
+					b.Fatal(err)
+				}
+				deadline := time.Now().Add(5 * time.Second)
+				for h.pubsub.natsconn.Stats().InMsgs-start < want {
+					if time.Now().After(deadline) {
+						b.Fatalf("node received %d of %d messages",
+							h.pubsub.natsconn.Stats().InMsgs-start, want)
+					}
+					runtime.Gosched()
+				}
+			}
+			b.StopTimer()
+			got := h.pubsub.natsconn.Stats().InMsgs - start
+			b.ReportMetric(float64(got)/float64(b.N), "received/op")
+		})
+	}
+}
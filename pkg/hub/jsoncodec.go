@@ -0,0 +1,145 @@
+package sockets
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/woogles-io/liwords/rpc/api/proto/ipc"
+)
+
+// The JSON protocol is a debugging aid. A client that connects with
+// ?format=json gets every event as its own text message, in the form
+//
+//	{"type": "CHAT_MESSAGE", "message": {...protojson...}}
+//
+// and may send events upstream in the same form. We translate to and from
+// the usual binary frames at the edge, so nothing behind the socket server
+// knows the difference.
+
+// messageTypes maps each message type to the proto message it carries. It
+// mirrors the table in the front end's socket_handlers.ts.
+var messageTypes = map[pb.MessageType]func() proto.Message{
+	pb.MessageType_SEEK_REQUEST:                                 func() proto.Message { return &pb.SeekRequest{} },
+	pb.MessageType_ERROR_MESSAGE:                                func() proto.Message { return &pb.ErrorMessage{} },
+	pb.MessageType_SERVER_MESSAGE:                               func() proto.Message { return &pb.ServerMessage{} },
+	pb.MessageType_NEW_GAME_EVENT:                               func() proto.Message { return &pb.NewGameEvent{} },
+	pb.MessageType_GAME_HISTORY_REFRESHER:                       func() proto.Message { return &pb.GameHistoryRefresher{} },
+	pb.MessageType_MATCH_REQUEST:                                func() proto.Message { return &pb.SeekRequest{} },
+	pb.MessageType_SOUGHT_GAME_PROCESS_EVENT:                    func() proto.Message { return &pb.SoughtGameProcessEvent{} },
+	pb.MessageType_CLIENT_GAMEPLAY_EVENT:                        func() proto.Message { return &pb.ClientGameplayEvent{} },
+	pb.MessageType_SERVER_GAMEPLAY_EVENT:                        func() proto.Message { return &pb.ServerGameplayEvent{} },
+	pb.MessageType_GAME_ENDED_EVENT:                             func() proto.Message { return &pb.GameEndedEvent{} },
+	pb.MessageType_SERVER_CHALLENGE_RESULT_EVENT:                func() proto.Message { return &pb.ServerChallengeResultEvent{} },
+	pb.MessageType_SEEK_REQUESTS:                                func() proto.Message { return &pb.SeekRequests{} },
+	pb.MessageType_TIMED_OUT:                                    func() proto.Message { return &pb.TimedOut{} },
+	pb.MessageType_ONGOING_GAME_EVENT:                           func() proto.Message { return &pb.GameInfoResponse{} },
+	pb.MessageType_ONGOING_GAMES:                                func() proto.Message { return &pb.GameInfoResponses{} },
+	pb.MessageType_GAME_DELETION:                                func() proto.Message { return &pb.GameDeletion{} },
+	pb.MessageType_MATCH_REQUESTS:                               func() proto.Message { return &pb.SeekRequests{} },
+	pb.MessageType_DECLINE_SEEK_REQUEST:                         func() proto.Message { return &pb.DeclineSeekRequest{} },
+	pb.MessageType_CHAT_MESSAGE:                                 func() proto.Message { return &pb.ChatMessage{} },
+	pb.MessageType_USER_PRESENCE:                                func() proto.Message { return &pb.UserPresence{} },
+	pb.MessageType_USER_PRESENCES:                               func() proto.Message { return &pb.UserPresences{} },
+	pb.MessageType_READY_FOR_GAME:                               func() proto.Message { return &pb.ReadyForGame{} },
+	pb.MessageType_READY_FOR_TOURNAMENT_GAME:                    func() proto.Message { return &pb.ReadyForTournamentGame{} },
+	pb.MessageType_TOURNAMENT_ROUND_STARTED:                     func() proto.Message { return &pb.TournamentRoundStarted{} },
+	pb.MessageType_LAG_MEASUREMENT:                              func() proto.Message { return &pb.LagMeasurement{} },
+	pb.MessageType_TOURNAMENT_GAME_ENDED_EVENT:                  func() proto.Message { return &pb.TournamentGameEndedEvent{} },
+	pb.MessageType_REMATCH_STARTED:                              func() proto.Message { return &pb.RematchStartedEvent{} },
+	pb.MessageType_GAME_META_EVENT:                              func() proto.Message { return &pb.GameMetaEvent{} },
+	pb.MessageType_TOURNAMENT_FULL_DIVISIONS_MESSAGE:            func() proto.Message { return &pb.FullTournamentDivisions{} },
+	pb.MessageType_TOURNAMENT_DIVISION_ROUND_CONTROLS_MESSAGE:   func() proto.Message { return &pb.DivisionRoundControls{} },
+	pb.MessageType_TOURNAMENT_DIVISION_PAIRINGS_MESSAGE:         func() proto.Message { return &pb.DivisionPairingsResponse{} },
+	pb.MessageType_TOURNAMENT_DIVISION_CONTROLS_MESSAGE:         func() proto.Message { return &pb.DivisionControlsResponse{} },
+	pb.MessageType_TOURNAMENT_DIVISION_PLAYER_CHANGE_MESSAGE:    func() proto.Message { return &pb.PlayersAddedOrRemovedResponse{} },
+	pb.MessageType_TOURNAMENT_FINISHED_MESSAGE:                  func() proto.Message { return &pb.TournamentFinishedResponse{} },
+	pb.MessageType_TOURNAMENT_DIVISION_DELETED_MESSAGE:          func() proto.Message { return &pb.TournamentDivisionDeletedResponse{} },
+	pb.MessageType_TOURNAMENT_DIVISION_PAIRINGS_DELETED_MESSAGE: func() proto.Message { return &pb.DivisionPairingsDeletedResponse{} },
+	pb.MessageType_CHAT_MESSAGE_DELETED:                         func() proto.Message { return &pb.ChatMessageDeleted{} },
+	pb.MessageType_TOURNAMENT_MESSAGE:                           func() proto.Message { return &pb.TournamentDataResponse{} },
+	pb.MessageType_TOURNAMENT_DIVISION_MESSAGE:                  func() proto.Message { return &pb.TournamentDivisionDataResponse{} },
+	pb.MessageType_PRESENCE_ENTRY:                               func() proto.Message { return &pb.PresenceEntry{} },
+	pb.MessageType_ACTIVE_GAME_ENTRY:                            func() proto.Message { return &pb.ActiveGameEntry{} },
+	pb.MessageType_PROFILE_UPDATE_EVENT:                         func() proto.Message { return &pb.ProfileUpdate{} },
+	pb.MessageType_OMGWORDS_GAMEPLAY_EVENT:                      func() proto.Message { return &pb.ServerOMGWordsEvent{} },
+	pb.MessageType_OMGWORDS_GAMEDOCUMENT:                        func() proto.Message { return &pb.GameDocumentEvent{} },
+}
+
+// jsonEvent is the JSON protocol's envelope for a single event.
+type jsonEvent struct {
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+// framesToJSON converts a binary frame, which may hold several events back
+// to back, into one JSON document per event.
+func framesToJSON(data []byte) ([][]byte, error) {
+	docs := [][]byte{}
+	for len(data) > 0 {
+		if len(data) < frameHeaderLen+1 {
+			return nil, errors.New("truncated frame header")
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		if n < 1 || len(data) < frameHeaderLen+n {
+			return nil, errors.New("truncated frame")
+		}
+		msgType := pb.MessageType(data[frameHeaderLen])
+		body := data[frameHeaderLen+1 : frameHeaderLen+n]
+		data = data[frameHeaderLen+n:]
+
+		newMsg, ok := messageTypes[msgType]
+		if !ok {
+			return nil, fmt.Errorf("no proto message for type %v", msgType)
+		}
+		msg := newMsg()
+		if err := proto.Unmarshal(body, msg); err != nil {
+			return nil, err
+		}
+		msgJSON, err := protojson.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := json.Marshal(jsonEvent{Type: msgType.String(), Message: msgJSON})
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// jsonToFrame converts a single JSON event into a binary frame.
+func jsonToFrame(doc []byte) ([]byte, error) {
+	evt := jsonEvent{}
+	if err := json.Unmarshal(doc, &evt); err != nil {
+		return nil, err
+	}
+	typeVal, ok := pb.MessageType_value[evt.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %q", evt.Type)
+	}
+	msgType := pb.MessageType(typeVal)
+	newMsg, ok := messageTypes[msgType]
+	if !ok {
+		return nil, fmt.Errorf("no proto message for type %v", msgType)
+	}
+	msg := newMsg()
+	if len(evt.Message) > 0 {
+		if err := protojson.Unmarshal(evt.Message, msg); err != nil {
+			return nil, err
+		}
+	}
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, frameHeaderLen+1, frameHeaderLen+1+len(body))
+	binary.BigEndian.PutUint16(frame, uint16(len(body)+1))
+	frame[frameHeaderLen] = byte(msgType)
+	return append(frame, body...), nil
+}
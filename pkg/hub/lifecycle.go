@@ -0,0 +1,206 @@
+package sockets
+
+import (
+	"context"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// A client goes through these states:
+//
+//	pending ──addClient──▶ registered ──removeClient──▶ closing ──▶ closed
+//	   │                                                              ▲
+//	   └──────────── unregistered before the hub added it ────────────┘
+//
+// Only Run moves a client out of pending, and only Run closes send, once
+// the client is closed. Anyone may queue frames with enqueue up until the
+// client starts closing; after that, frames are dropped rather than sent on
+// a closed channel.
+//
+// A pending client's pumps already run, so it may send before it is
+// registered; a seek sent right after connecting is common. Up to
+// maxHeldMessages of those are held, and published when addClient
+// registers the client, before anything it sends afterwards.
+type connState int
+
+const (
+	// statePending clients have connected but the hub hasn't added them.
+	statePending connState = iota
+	// stateRegistered clients are in the hub's maps and get broadcasts.
+	stateRegistered
+	// stateClosing clients are being taken out of the hub's maps.
+	stateClosing
+	// stateClosed clients have had their send channel closed.
+	stateClosed
+)
+
+func (s connState) String() string {
+	switch s {
+	case statePending:
+		return "pending"
+	case stateRegistered:
+		return "registered"
+	case stateClosing:
+		return "closing"
+	case stateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// A closeCode tells the client why we closed its connection. Codes below
+// 4000 are from RFC 6455; 4000-4999 are reserved for private use.
+type closeCode int
+
+const (
+	// closeBanned means the user or their IP is banned.
+	closeBanned closeCode = websocket.ClosePolicyViolation
+	// closeKicked means an admin kicked the connection.
+	closeKicked closeCode = 4001
+	// closeProtocolNotAllowed means the client asked for a protocol it may
+	// not use.
+	closeProtocolNotAllowed closeCode = 4002
+	// closeTooSlow means the client's send buffer filled up.
+	closeTooSlow closeCode = 4003
+	// closeReplaced means a newer connection from the same user took over
+	// the connection ID.
+	closeReplaced closeCode = 4004
+	// closeDuplicateConnID means another user's connection has the ID.
+	closeDuplicateConnID closeCode = 4005
+	// closeAuthFailed means the client's token was missing or invalid, or
+	// didn't arrive in time.
+	closeAuthFailed closeCode = 4006
+	// closeBadConnID means the client asked for a connection ID it may not
+	// have.
+	closeBadConnID closeCode = 4007
+	// closeTooManyConns means one of the connection caps was hit.
+	closeTooManyConns closeCode = 4008
+	// closeTryAgainLater means we couldn't set the connection up on our
+	// side, e.g. because NATS is down.
+	closeTryAgainLater closeCode = websocket.CloseTryAgainLater
+)
+
+// maxHeldMessages is how many messages a pending client may send before the
+// rest are refused.
+const maxHeldMessages = 32
+
+// A heldMessage is one a client sent while it was pending.
+type heldMessage struct {
+	ctx      context.Context
+	msg      []byte
+	received time.Time
+}
+
+// maxCloseReasonLen is as long as a close reason can be: a control frame
+// carries at most 125 bytes, two of which are the code.
+const maxCloseReasonLen = 123
+
+func (c *Client) currentState() connState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state
+}
+
+// transition moves the client from one state to another, and says whether
+// it was in the from state.
+func (c *Client) transition(from, to connState) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state != from {
+		return false
+	}
+	c.state = to
+	return true
+}
+
+// hold holds the message if the client is pending, and says whether it was.
+// It returns errNotRegistered if the client has sent too much to hold.
+func (c *Client) hold(m heldMessage) (bool, error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state != statePending {
+		return false, nil
+	}
+	if len(c.held) >= maxHeldMessages {
+		return true, errNotRegistered
+	}
+	c.held = append(c.held, m)
+	return true, nil
+}
+
+// register moves the client from pending to registered, and says whether
+// it was pending. publish is called for each held message first, with the
+// lock held, so that they go out before anything sent afterwards.
+func (c *Client) register(publish func(heldMessage)) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state != statePending {
+		return false
+	}
+	for _, m := range c.held {
+		publish(m)
+	}
+	c.held = nil
+	c.state = stateRegistered
+	return true
+}
+
+// beginClose moves the client to closing, recording why, unless it is
+// already on its way out. It says whether it did anything. Reasons too long
+// for a close frame are cut short.
+func (c *Client) beginClose(code closeCode, reason string) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state >= stateClosing {
+		return false
+	}
+	c.state = stateClosing
+	c.closeCode = code
+	c.closeReason = truncateReason(reason)
+	return true
+}
+
+// truncateReason cuts the reason to maxCloseReasonLen bytes, without
+// splitting a character.
+func truncateReason(reason string) string {
+	if len(reason) <= maxCloseReasonLen {
+		return reason
+	}
+	// Back up to the start of the character we'd otherwise cut in two.
+	i := maxCloseReasonLen
+	for i > 0 && !utf8.RuneStart(reason[i]) {
+		i--
+	}
+	return reason[:i]
+}
+
+// finishClose closes the client's send channel. The client must be closing.
+func (c *Client) finishClose() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state != stateClosing {
+		return
+	}
+	c.state = stateClosed
+	close(c.send)
+}
+
+// enqueue queues a frame for the client without blocking. It returns false
+// if the frame was dropped because the client is closing or its buffer is
+// full. Run sends to registered clients directly; everyone else must use
+// this.
+func (c *Client) enqueue(f outboundFrame) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state >= stateClosing {
+		return false
+	}
+	select {
+	case c.send <- f:
+		return true
+	default:
+		return false
+	}
+}
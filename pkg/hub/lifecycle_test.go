@@ -0,0 +1,227 @@
+package sockets
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	nats "github.com/nats-io/nats.go"
+	pb "github.com/woogles-io/liwords/rpc/api/proto/ipc"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDropPendingBeforeAddClient(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	c := newTestClient(h, "u1", "c1", "lobby")
+
+	if !h.dropPending(c, 0, "left before registering") {
+		t.Fatal("dropPending refused a pending client")
+	}
+	if err := h.addClient(c); err == nil {
+		t.Fatal("addClient accepted a dropped client")
+	}
+	if got := c.currentState(); got != stateClosed {
+		t.Errorf("state = %v, want closed", got)
+	}
+	if _, ok := h.clients[c]; ok {
+		t.Error("dropped client is in clients")
+	}
+	if _, ok := h.clientsByConnID["c1"]; ok {
+		t.Error("dropped client is in clientsByConnID")
+	}
+	if len(h.realms[LobbyRealm]) != 0 {
+		t.Error("dropped client is in the lobby")
+	}
+	if !drained(c) {
+		t.Error("send was not closed")
+	}
+}
+
+func TestDropPendingAfterAddClient(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	c := newTestClient(h, "u1", "c1", "lobby")
+
+	if err := h.addClient(c); err != nil {
+		t.Fatal(err)
+	}
+	if h.dropPending(c, 0, "left before registering") {
+		t.Fatal("dropPending took a registered client")
+	}
+	if got := c.currentState(); got != stateRegistered {
+		t.Errorf("state = %v, want registered", got)
+	}
+	if !h.realms[LobbyRealm][c] {
+		t.Error("client is not in the lobby")
+	}
+
+	h.removeClient(c)
+	if got := c.currentState(); got != stateClosed {
+		t.Errorf("state after removeClient = %v, want closed", got)
+	}
+	if !drained(c) {
+		t.Error("send was not closed")
+	}
+}
+
+func TestLateRegisterAfterUnregister(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	go h.Run()
+	c := newTestClient(h, "u1", "c1", "lobby")
+
+	// The pumps give up before registerAsync is done.
+	h.unregister <- c
+	h.register <- c
+
+	if n := connCount(h); n != 0 {
+		t.Errorf("hub has %d clients, want 0", n)
+	}
+	if got := c.currentState(); got != stateClosed {
+		t.Errorf("state = %v, want closed", got)
+	}
+	if !drained(c) {
+		t.Error("send was not closed")
+	}
+}
+
+func TestEnqueueAfterClose(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	c := newTestClient(h, "u1", "c1")
+
+	if !c.enqueue(outboundFrame{data: []byte("hi")}) {
+		t.Fatal("enqueue refused a pending client")
+	}
+	if !c.beginClose(closeKicked, "bye") {
+		t.Fatal("beginClose did nothing")
+	}
+	if c.enqueue(outboundFrame{data: []byte("closing")}) {
+		t.Error("enqueue queued a frame for a closing client")
+	}
+	c.finishClose()
+	// This would panic if it sent on the closed channel.
+	if c.enqueue(outboundFrame{data: []byte("closed")}) {
+		t.Error("enqueue queued a frame for a closed client")
+	}
+	if c.beginClose(closeTooSlow, "again") {
+		t.Error("beginClose closed a closed client")
+	}
+	if c.closeCode != closeKicked {
+		t.Errorf("closeCode = %d, want %d", c.closeCode, closeKicked)
+	}
+}
+
+func TestTruncateReason(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		reason string
+		want   int
+	}{
+		{"short", "too slow", 8},
+		{"exact", strings.Repeat("a", maxCloseReasonLen), maxCloseReasonLen},
+		{"ascii", strings.Repeat("a", 300), maxCloseReasonLen},
+		// Two-byte characters; the 62nd would straddle the limit.
+		{"utf8", strings.Repeat("é", 100), 122},
+	} {
+		got := truncateReason(tc.reason)
+		if len(got) != tc.want {
+			t.Errorf("%s: len = %d, want %d", tc.name, len(got), tc.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%s: %q is not valid UTF-8", tc.name, got)
+		}
+		if !strings.HasPrefix(tc.reason, got) {
+			t.Errorf("%s: %q is not a prefix of the reason", tc.name, got)
+		}
+	}
+}
+
+// A client that sends straight after connecting, while its realms are
+// still being registered, must not lose the message.
+func TestSendWhilePending(t *testing.T) {
+	ns := newTestNats(t)
+	h := newTestHub(t, ns)
+	url := serveTestWS(t, h) + "/ws?path=/game/x"
+
+	api, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+	registered := make(chan struct{})
+	_, err = api.Subscribe("ipc.request.registerRealm", func(m *nats.Msg) {
+		// Slow enough that the client sends while pending.
+		time.Sleep(200 * time.Millisecond)
+		close(registered)
+		data, _ := proto.Marshal(&pb.RegisterRealmResponse{Realms: []string{"game-x"}})
+		m.Respond(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	published, err := api.SubscribeSync("ipc.pb.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := websocket.Dialer{Subprotocols: []string{
+		protocolV2, tokenProtocolPrefix + newTestToken(t, "u1", nil)}}
+	ws, _, err := d.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for _, body := range []string{"first", "second"} {
+		msg := append([]byte{0, byte(len(body) + 1), 9}, body...)
+		if err := ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for len(got) < 2 {
+		m, err := published.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("published %q, then: %v", got, err)
+		}
+		if !strings.HasPrefix(m.Subject, "ipc.pb.9.auth.u1.") {
+			continue
+		}
+		select {
+		case <-registered:
+		default:
+			t.Fatalf("%s was published before the client was registered", m.Data)
+		}
+		got = append(got, string(m.Data))
+	}
+	if got[0] != "first" || got[1] != "second" {
+		t.Errorf("published %q, want first then second", got)
+	}
+}
+
+func TestHoldLimit(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	c := newTestClient(h, "u1", "c1")
+	for i := 0; i < maxHeldMessages; i++ {
+		if held, err := c.hold(heldMessage{msg: []byte{0, 1, 9}}); !held || err != nil {
+			t.Fatalf("message %d: held %v, %v", i, held, err)
+		}
+	}
+	if _, err := c.hold(heldMessage{msg: []byte{0, 1, 9}}); err != errNotRegistered {
+		t.Errorf("one too many: err = %v, want %v", err, errNotRegistered)
+	}
+
+	var published int
+	if !c.register(func(heldMessage) { published++ }) {
+		t.Fatal("register refused a pending client")
+	}
+	if published != maxHeldMessages {
+		t.Errorf("published %d held messages, want %d", published, maxHeldMessages)
+	}
+	if held, _ := c.hold(heldMessage{msg: []byte{0, 1, 9}}); held {
+		t.Error("held a message from a registered client")
+	}
+}
@@ -0,0 +1,104 @@
+package sockets
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+)
+
+// Every connection costs a couple of goroutines, a send buffer and a
+// registerRealm request, so we cap how many one user can have open at once.
+// Authenticated users are capped by user ID. Anonymous users get a fresh
+// user ID whenever they like, so they are capped by IP instead, with a
+// looser limit since many people can share an address. There is also a cap
+// on the node as a whole. A limit of 0 means no limit.
+
+var (
+	errTooManyConns       = errors.New("too many connections")
+	errTooManyUserConns   = errors.New("too many connections for this user")
+	errTooManyAnonIPConns = errors.New("too many anonymous connections from this address")
+)
+
+var (
+	connsOpen     = expvar.NewInt("conns-open")
+	connsRejected = expvar.NewMap("conns-rejected")
+)
+
+type connLimiter struct {
+	sync.Mutex
+	maxTotal     int
+	maxPerUser   int
+	maxPerAnonIP int
+
+	total    int
+	byUser   map[string]int
+	byAnonIP map[string]int
+}
+
+func newConnLimiter(maxTotal, maxPerUser, maxPerAnonIP int) *connLimiter {
+	return &connLimiter{
+		maxTotal:     maxTotal,
+		maxPerUser:   maxPerUser,
+		maxPerAnonIP: maxPerAnonIP,
+		byUser:       make(map[string]int),
+		byAnonIP:     make(map[string]int),
+	}
+}
+
+// acquire reserves a connection for the client, which must have logged in.
+// Every successful acquire must be matched by a release.
+func (l *connLimiter) acquire(c *Client) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		connsRejected.Add("total", 1)
+		return errTooManyConns
+	}
+	if c.authenticated {
+		if l.maxPerUser > 0 && l.byUser[c.userID] >= l.maxPerUser {
+			connsRejected.Add("user", 1)
+			return errTooManyUserConns
+		}
+		l.byUser[c.userID]++
+	} else {
+		if l.maxPerAnonIP > 0 && l.byAnonIP[c.ip] >= l.maxPerAnonIP {
+			connsRejected.Add("anon-ip", 1)
+			return errTooManyAnonIPConns
+		}
+		l.byAnonIP[c.ip]++
+	}
+	l.total++
+	c.limited = true
+	connsOpen.Set(int64(l.total))
+	return nil
+}
+
+// release gives back the client's connection. It is safe to call more than
+// once, or without a successful acquire.
+func (l *connLimiter) release(c *Client) {
+	l.Lock()
+	defer l.Unlock()
+	if !c.limited {
+		return
+	}
+	c.limited = false
+	if c.authenticated {
+		if l.byUser[c.userID]--; l.byUser[c.userID] <= 0 {
+			delete(l.byUser, c.userID)
+		}
+	} else {
+		if l.byAnonIP[c.ip]--; l.byAnonIP[c.ip] <= 0 {
+			delete(l.byAnonIP, c.ip)
+		}
+	}
+	l.total--
+	connsOpen.Set(int64(l.total))
+}
+
+// usage returns the number of open connections, and whether the node is at
+// its cap.
+func (l *connLimiter) usage() (int, bool) {
+	l.Lock()
+	defer l.Unlock()
+	return l.total, l.maxTotal > 0 && l.total >= l.maxTotal
+}
@@ -0,0 +1,104 @@
+package sockets
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// In production NATS should only let socket nodes do what they need to. The
+// permissions a node needs, under its subject prefix if it has one, are:
+//
+//	subscribe: the topics in newPubSub, <kind>.> for each of interestKinds,
+//	           and _INBOX.> (never prefixed) for replies
+//	publish:   ipc.pb.>, ipc.json.>, ipc.request.>, broadcast.> and, if the
+//	           audit log goes to NATS, <audit-subject>.>
+//
+// NATS only reports a permissions violation asynchronously, so a node that
+// is missing one would look healthy while dropping messages. checkPermissions
+// tries them at startup instead, and fails if any is refused.
+//
+// Subscribing is always checked; nobody else sees it. The only way to test
+// a publish permission is to publish, though, so that check sends empty
+// messages to permissionCheck subjects under each tree, where the API and
+// anything else subscribed will see them. The API ignores them as it
+// doesn't know the message type and we skip broadcast.permissionCheck, but
+// other consumers may not, so publishing is only checked with
+// -nats-check-publish-permissions.
+
+const (
+	permissionCheckTimeout = 5 * time.Second
+	permissionProbe        = "permissionCheck"
+)
+
+// checkPermissions checks that we may subscribe to our topics, which must
+// already be subscribed, and publish to the given subjects, if any.
+func (ps *PubSub) checkPermissions(publish []string) error {
+	nc := ps.natsconn
+	var refused []string
+	for _, sub := range ps.subscriptions {
+		if err := permissionErr(nc, "Subscription", sub.Subject); err != nil {
+			refused = append(refused, err.Error())
+		}
+	}
+	// We subscribe to these later on, so try a subject like the ones we
+	// will use.
+	probes := []string{nc.NewInbox()}
+	for _, kind := range interestKinds {
+		probes = append(probes, ps.subject(kind+"."+permissionProbe+".>"))
+	}
+	for _, subject := range probes {
+		sub, err := nc.SubscribeSync(subject)
+		if err != nil {
+			return err
+		}
+		if err := permissionErr(nc, "Subscription", subject); err != nil {
+			refused = append(refused, err.Error())
+		}
+		sub.Unsubscribe()
+	}
+	for _, subject := range publish {
+		subject = ps.subject(subject)
+		if err := nc.Publish(subject, nil); err != nil {
+			return err
+		}
+		if err := permissionErr(nc, "Publish", subject); err != nil {
+			refused = append(refused, err.Error())
+		}
+	}
+	if len(refused) > 0 {
+		return fmt.Errorf("missing NATS permissions: %s", strings.Join(refused, "; "))
+	}
+	return nil
+}
+
+// permissionErr waits for the server to catch up, and returns the error if
+// it refused the last thing we did on the subject.
+func permissionErr(nc *nats.Conn, op, subject string) error {
+	if err := nc.FlushTimeout(permissionCheckTimeout); err != nil {
+		return err
+	}
+	err := nc.LastError()
+	if errors.Is(err, nats.ErrPermissionViolation) &&
+		strings.Contains(strings.ToLower(err.Error()), strings.ToLower(op+` to "`+subject+`"`)) {
+		return fmt.Errorf("%s to %q", strings.ToLower(op), subject)
+	}
+	return nil
+}
+
+// permissionProbes returns the subjects to test publishing to.
+func permissionProbes(auditSubject string) []string {
+	probes := []string{
+		"ipc.pb." + permissionProbe + ".anon." + permissionProbe + "." + permissionProbe,
+		"ipc.json." + permissionProbe + ".anon." + permissionProbe + "." + permissionProbe,
+		"ipc.request." + permissionProbe,
+		"broadcast." + permissionProbe,
+	}
+	if auditSubject != "" {
+		probes = append(probes, auditSubject+"."+permissionProbe)
+	}
+	return probes
+}
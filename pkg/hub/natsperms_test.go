@@ -0,0 +1,86 @@
+package sockets
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natstest "github.com/nats-io/nats-server/v2/test"
+
+	"github.com/woogles-io/liwords-socket/pkg/config"
+)
+
+// newPermissionedNats starts a NATS server with one user, who may do
+// anything but what deny says.
+func newPermissionedNats(t *testing.T, deny *server.Permissions) string {
+	opts := natstest.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	perms := &server.Permissions{
+		Publish:   &server.SubjectPermission{Allow: []string{">"}},
+		Subscribe: &server.SubjectPermission{Allow: []string{">"}},
+	}
+	if deny.Publish != nil {
+		perms.Publish.Deny = deny.Publish.Deny
+	}
+	if deny.Subscribe != nil {
+		perms.Subscribe.Deny = deny.Subscribe.Deny
+	}
+	opts.Users = []*server.User{{Username: "socket", Password: "pw", Permissions: perms}}
+	ns := natstest.RunServer(&opts)
+	t.Cleanup(ns.Shutdown)
+	return fmt.Sprintf("nats://socket:pw@%s", strings.TrimPrefix(ns.ClientURL(), "nats://"))
+}
+
+func TestCheckPermissions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		deny    *server.Permissions
+		publish bool
+		refused string
+	}{
+		{"all allowed", &server.Permissions{}, true, ""},
+		{
+			name:    "subscribe denied",
+			deny:    &server.Permissions{Subscribe: &server.SubjectPermission{Deny: []string{"bans.>"}}},
+			refused: `subscription to "bans.>"`,
+		},
+		{
+			name:    "interest subscribe denied",
+			deny:    &server.Permissions{Subscribe: &server.SubjectPermission{Deny: []string{"game.>"}}},
+			refused: `subscription to "game.permissionCheck.>"`,
+		},
+		{
+			// Publishing isn't checked unless asked for.
+			name: "publish denied, unchecked",
+			deny: &server.Permissions{Publish: &server.SubjectPermission{Deny: []string{"ipc.request.>"}}},
+		},
+		{
+			name:    "publish denied",
+			deny:    &server.Permissions{Publish: &server.SubjectPermission{Deny: []string{"ipc.request.>"}}},
+			publish: true,
+			refused: `publish to "ipc.request.permissionCheck"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := []string{"-nats-url", newPermissionedNats(t, tc.deny)}
+			if tc.publish {
+				args = append(args, "-nats-check-publish-permissions")
+			}
+			cfg := &config.Config{}
+			if err := cfg.Load(args); err != nil {
+				t.Fatal(err)
+			}
+			h, err := NewHub(cfg)
+			if err == nil {
+				h.pubsub.natsconn.Close()
+			}
+			switch {
+			case tc.refused == "" && err != nil:
+				t.Errorf("NewHub: %v", err)
+			case tc.refused != "" && (err == nil || !strings.Contains(err.Error(), tc.refused)):
+				t.Errorf("NewHub: %v, want an error about %s", err, tc.refused)
+			}
+		})
+	}
+}
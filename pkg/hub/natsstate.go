@@ -0,0 +1,97 @@
+package sockets
+
+import (
+	"expvar"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+
+	"github.com/woogles-io/liwords-socket/pkg/config"
+)
+
+// Everything clients see comes to us over NATS, so while the connection is
+// down their boards just freeze. The NATS client reconnects by itself and
+// resubscribes for us; what we add is telling clients about it. When the
+// connection drops, every client gets a realtime-degraded notice, and when
+// it comes back they get realtime-restored, and the API is asked to resend
+// the state of each client's realms, since whatever was published in
+// between is gone.
+
+var natsEvents = expvar.NewMap("nats-events")
+
+// natsOptions returns the connection options from the config.
+func natsOptions(cfg *config.Config) ([]nats.Option, error) {
+	opts := []nats.Option{
+		nats.MaxReconnects(cfg.NatsMaxReconnects),
+		nats.ReconnectWait(cfg.NatsReconnectWait),
+		nats.ReconnectBufSize(cfg.NatsReconnectBufMB << 20),
+	}
+	if cfg.NatsCAFile != "" {
+		opts = append(opts, nats.RootCAs(cfg.NatsCAFile))
+	}
+	if cfg.NatsCertFile != "" || cfg.NatsKeyFile != "" {
+		opts = append(opts, nats.ClientCert(cfg.NatsCertFile, cfg.NatsKeyFile))
+	}
+	if cfg.NatsCredsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.NatsCredsFile))
+	}
+	if cfg.NatsNkeySeedFile != "" {
+		opt, err := nats.NkeyOptionFromSeed(cfg.NatsNkeySeedFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	if cfg.NatsToken != "" {
+		opts = append(opts, nats.Token(cfg.NatsToken))
+	}
+	return opts, nil
+}
+
+// watchNats sets the connection's handlers. They hand state changes to Run.
+func (h *Hub) watchNats(nc *nats.Conn) {
+	nc.SetDisconnectErrHandler(func(nc *nats.Conn, err error) {
+		natsEvents.Add("disconnects", 1)
+		log.Err(err).Msg("nats-disconnected")
+		h.natsUp <- false
+	})
+	nc.SetReconnectHandler(func(nc *nats.Conn) {
+		natsEvents.Add("reconnects", 1)
+		log.Info().Str("url", nc.ConnectedUrlRedacted()).Msg("nats-reconnected")
+		h.natsUp <- true
+	})
+	nc.SetClosedHandler(func(nc *nats.Conn) {
+		// We only get here once reconnecting has given up, or on shutdown.
+		natsEvents.Add("closed", 1)
+		log.Error().Err(nc.LastError()).Msg("nats-closed")
+	})
+}
+
+// natsStateChanged is called from Run.
+func (h *Hub) natsStateChanged(up bool) {
+	if up == !h.natsDown {
+		return
+	}
+	h.natsDown = !up
+	if !up {
+		h.deliverNotice(noticeMessage{audience: noticeAll, notice: Notice{
+			Kind:    "realtime-degraded",
+			Message: "Realtime service is degraded; updates may be delayed.",
+		}})
+		return
+	}
+	h.deliverNotice(noticeMessage{audience: noticeAll, notice: Notice{
+		Kind:    "realtime-restored",
+		Message: "Realtime service has been restored.",
+	}})
+	// We missed any realm cache invalidations published while we were
+	// away, so nothing in the cache can be trusted.
+	n := h.realmCache.invalidate(realmCacheInvalidation{})
+	log.Info().Int("entries", n).Msg("realm-cache-cleared")
+	for c := range h.clients {
+		if err := h.sendRealmInitInfo(c); err != nil {
+			log.Err(err).Str("connID", c.connID).Msg("resync-realm-info")
+		}
+	}
+	log.Info().Int("clients", len(h.clients)).Msg("resynced-clients")
+}
@@ -0,0 +1,166 @@
+package sockets
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/woogles-io/liwords/pkg/entity"
+	pb "github.com/woogles-io/liwords/rpc/api/proto/ipc"
+)
+
+// Notices are server-initiated messages to many clients at once, e.g. "deploy
+// in 5 minutes". They go out over NATS so that every node delivers them, and
+// they don't need the liwords API to be up. The subject picks the audience:
+//
+//	broadcast.all               every client
+//	broadcast.auth              authenticated clients
+//	broadcast.anon              anonymous clients
+//	broadcast.realm.<prefix>    clients in a realm starting with <prefix>
+//
+// The payload is a JSON Notice.
+
+const (
+	noticeAll   = "all"
+	noticeAuth  = "auth"
+	noticeAnon  = "anon"
+	noticeRealm = "realm"
+)
+
+// A Notice is a message for clients to display. ReconnectAt and ShutdownAt
+// are optional; the front end can use them to render a countdown.
+type Notice struct {
+	Kind        string     `json:"kind"`
+	Message     string     `json:"message"`
+	ReconnectAt *time.Time `json:"reconnectAt,omitempty"`
+	ShutdownAt  *time.Time `json:"shutdownAt,omitempty"`
+}
+
+// A noticeMessage is a notice along with who should get it.
+type noticeMessage struct {
+	audience    string
+	realmPrefix string
+	notice      Notice
+}
+
+// noticeControl is the control message form of a Notice.
+type noticeControl struct {
+	Type string `json:"type"`
+	Notice
+}
+
+// noticeSubject returns the subject to publish a notice to.
+func noticeSubject(audience, realmPrefix string) (string, error) {
+	switch audience {
+	case noticeAll, noticeAuth, noticeAnon:
+		return "broadcast." + audience, nil
+	case noticeRealm:
+		if realmPrefix == "" || strings.ContainsAny(realmPrefix, ".*> ") {
+			return "", errors.New("bad realm prefix")
+		}
+		return "broadcast." + noticeRealm + "." + realmPrefix, nil
+	}
+	return "", errors.New("unknown audience")
+}
+
+// parseNoticeSubject is the inverse of noticeSubject.
+func parseNoticeSubject(subject string) (audience, realmPrefix string, err error) {
+	subtopics := strings.SplitN(subject, ".", 3)
+	if len(subtopics) < 2 {
+		return "", "", errors.New("no audience")
+	}
+	audience = subtopics[1]
+	if audience == noticeRealm {
+		if len(subtopics) < 3 {
+			return "", "", errors.New("no realm prefix")
+		}
+		realmPrefix = subtopics[2]
+	}
+	return audience, realmPrefix, nil
+}
+
+// publishNotice sends a notice to every node.
+func (h *Hub) publishNotice(audience, realmPrefix string, n Notice) error {
+	subject, err := noticeSubject(audience, realmPrefix)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return h.pubsub.publish(subject, data)
+}
+
+func (h *Hub) sendNotice(msg noticeMessage) {
+	h.broadcastNotice <- msg
+}
+
+func (msg noticeMessage) wants(c *Client) bool {
+	switch msg.audience {
+	case noticeAll:
+		return true
+	case noticeAuth:
+		return c.authenticated
+	case noticeAnon:
+		return !c.authenticated
+	case noticeRealm:
+		for _, r := range c.realms {
+			if strings.HasPrefix(string(r), msg.realmPrefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// noticeFrames returns the notice in both of its forms: a control message,
+// and a server message for clients that don't understand those.
+func noticeFrames(n Notice) (control, legacy outboundFrame, err error) {
+	bts, err := json.Marshal(noticeControl{Type: "notice", Notice: n})
+	if err != nil {
+		return control, legacy, err
+	}
+	evt := entity.WrapEvent(&pb.ServerMessage{Message: n.Message}, pb.MessageType_SERVER_MESSAGE)
+	legacyBts, err := evt.Serialize()
+	if err != nil {
+		return control, legacy, err
+	}
+	return outboundFrame{data: bts, control: true}, outboundFrame{data: legacyBts}, nil
+}
+
+// pickNoticeFrame returns whichever form of a notice suits the client.
+func (c *Client) pickNoticeFrame(control, legacy outboundFrame) outboundFrame {
+	if c.hasCapability(CapControl) {
+		return control
+	}
+	return legacy
+}
+
+// deliverNotice is called from Run. Clients that understand control messages
+// get the whole notice; everyone else gets just the text, as a server message.
+func (h *Hub) deliverNotice(msg noticeMessage) {
+	control, legacy, err := noticeFrames(msg.notice)
+	if err != nil {
+		log.Err(err).Msg("error serializing notice")
+		return
+	}
+	sent := 0
+	for c := range h.clients {
+		if !msg.wants(c) {
+			continue
+		}
+		select {
+		case c.send <- c.pickNoticeFrame(control, legacy):
+			sent++
+		default:
+			log.Debug().Str("username", c.username).Msg("in deliverNotice, removeClient")
+			h.closeClient(c, closeTooSlow, "too slow")
+		}
+	}
+	log.Info().Str("audience", msg.audience).Str("realm-prefix", msg.realmPrefix).
+		Str("kind", msg.notice.Kind).Int("clients", sent).Msg("delivered-notice")
+}
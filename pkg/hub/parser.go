@@ -2,16 +2,37 @@ package sockets
 
 import (
 	"context"
+	"errors"
 	"strconv"
 	"time"
 
+	nats "github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/woogles-io/liwords-socket/pkg/tracing"
 )
 
+// Every message we publish for a client carries when we received it and
+// how laggy the client is, so that the game clock can give back time lost to
+// the network rather than charge it to the player.
 const (
-	ipcTimeout = 10 * time.Second
+	// receivedAtHeader is the receive time, in Unix milliseconds.
+	receivedAtHeader = "Liwords-Received-At"
+	// lagHeader is the client's average round trip time in milliseconds,
+	// as measured from pongs; the same number the client is sent in its
+	// LagMeasurement.
+	lagHeader = "Liwords-Lag-Ms"
+	// lagSamplesHeader is how many pongs went into lagHeader. With none
+	// there is no estimate yet.
+	lagSamplesHeader = "Liwords-Lag-Samples"
 )
 
+// errMessageTooShort is for messages without the two length bytes and the
+// type byte.
+var errMessageTooShort = errors.New("message too short")
+
 func extendTopic(c *Client, topic string) string {
 	// The publish topic should encode the user ID and the login status.
 	// This is so we don't have to wastefully unmarshal and remarshal here,
@@ -34,9 +55,44 @@ func (h *Hub) parseAndExecuteMessage(ctx context.Context, msg []byte, c *Client)
 
 	// The type byte is [2] ([0] and [1] are length of the packet)
 
+	received := time.Now()
+	if len(msg) < 3 {
+		return errMessageTooShort
+	}
+	if c.degraded.Load() {
+		return errDegraded
+	}
+	// Its subjects aren't subscribed until addClient, so the replies would
+	// be lost if we published now.
+	held, err := c.hold(heldMessage{context.WithoutCancel(ctx), msg, received})
+	if held {
+		return err
+	}
+	return h.publishMessage(ctx, c, msg, received)
+}
+
+// publishMessage publishes a message from the client to the API.
+func (h *Hub) publishMessage(ctx context.Context, c *Client, msg []byte, received time.Time) error {
 	topicName := "ipc.pb." + strconv.Itoa(int(msg[2]))
 	fullTopic := extendTopic(c, topicName)
 	log.Debug().Str("fullTopic", fullTopic).Msg("nats-publish")
 
-	return h.pubsub.natsconn.Publish(fullTopic, msg[3:])
+	ctx, span := tracer.Start(ctx, "publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", topicName),
+			attribute.String("conn.id", c.connID)))
+	out := nats.NewMsg(h.pubsub.subject(fullTopic))
+	out.Data = msg[3:]
+	c.RLock()
+	lag, samples := c.avglag, c.pongCount
+	c.RUnlock()
+	out.Header = nats.Header{}
+	out.Header.Set(receivedAtHeader, strconv.FormatInt(received.UnixMilli(), 10))
+	out.Header.Set(lagHeader, strconv.FormatInt(lag.Milliseconds(), 10))
+	out.Header.Set(lagSamplesHeader, strconv.Itoa(samples))
+	tracing.Inject(ctx, out)
+	err := h.pubsub.natsconn.PublishMsg(out)
+	endSpan(span, err)
+	return err
 }
@@ -0,0 +1,24 @@
+package sockets
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParseShortMessage(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	c := newTestClient(h, "u1", "c1", "lobby")
+	if err := h.addClient(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range [][]byte{nil, {0}, {0, 1}} {
+		err := h.parseAndExecuteMessage(context.Background(), msg, c)
+		if !errors.Is(err, errMessageTooShort) {
+			t.Errorf("%v: err = %v, want %v", msg, err, errMessageTooShort)
+		}
+	}
+	if err := h.parseAndExecuteMessage(context.Background(), []byte{0, 1, 7}, c); err != nil {
+		t.Errorf("a type byte with no body: %v", err)
+	}
+}
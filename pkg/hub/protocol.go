@@ -0,0 +1,152 @@
+package sockets
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// Websocket subprotocols. A client picks one with the Sec-WebSocket-Protocol
+// header; clients that don't send the header are treated as liwords.v1,
+// which is the protocol every front end spoke before we started versioning.
+//
+// liwords.v2 adds control messages: JSON text messages, separate from the
+// binary event frames, that the server uses to talk about the connection
+// itself. The first one on every v2 connection is a hello.
+const (
+	protocolV1 = "liwords.v1"
+	protocolV2 = "liwords.v2"
+)
+
+// supportedProtocols is in order of preference.
+var supportedProtocols = []string{protocolV2, protocolV1}
+
+// requestedProtocol returns the subprotocol the upgrader will pick for the
+// request: our most preferred one that the client offers.
+func requestedProtocol(r *http.Request) string {
+	offered := websocket.Subprotocols(r)
+	for _, p := range supportedProtocols {
+		if slices.Contains(offered, p) {
+			return p
+		}
+	}
+	return protocolV1
+}
+
+// A Capability is an optional protocol feature. A Client records the set
+// that is on for its connection.
+type Capability uint8
+
+const (
+	// CapBatching means several events may share one websocket message.
+	CapBatching Capability = 1 << iota
+	// CapCompression means permessage-deflate was negotiated.
+	CapCompression
+	// CapJSON means the client speaks the JSON debugging protocol.
+	CapJSON
+	// CapControl means the client understands control messages.
+	CapControl
+)
+
+var capabilityNames = []struct {
+	c    Capability
+	name string
+}{
+	{CapBatching, "batching"},
+	{CapCompression, "compression"},
+	{CapJSON, "json"},
+	{CapControl, "control"},
+}
+
+// Names returns the names of the capabilities in the set.
+func (c Capability) Names() []string {
+	names := []string{}
+	for _, cn := range capabilityNames {
+		if c.has(cn.c) {
+			names = append(names, cn.name)
+		}
+	}
+	return names
+}
+
+// serverCapabilities returns the capabilities this server offers the client.
+func (h *Hub) serverCapabilities(c *Client) Capability {
+	caps := CapBatching | CapControl
+	if h.cfg.WebsocketCompression {
+		caps |= CapCompression
+	}
+	if h.cfg.AllowJSONProtocol || c.hasPerm("adm") {
+		caps |= CapJSON
+	}
+	return caps
+}
+
+// negotiateCapabilities works out which capabilities are on for a freshly
+// upgraded websocket connection.
+func (h *Hub) negotiateCapabilities(c *Client, r *http.Request) Capability {
+	caps := Capability(0)
+	if c.protocol == protocolV2 {
+		caps |= CapControl
+	}
+	// The upgrader accepts permessage-deflate whenever compression is on
+	// and the client offers it.
+	if h.cfg.WebsocketCompression &&
+		strings.Contains(strings.Join(r.Header.Values("Sec-WebSocket-Extensions"), ","), "permessage-deflate") {
+		caps |= CapCompression
+	}
+	if r.URL.Query().Get("format") == "json" {
+		// One event per message.
+		caps |= CapJSON
+	} else {
+		caps |= CapBatching
+	}
+	return caps
+}
+
+func (c Capability) has(cap Capability) bool {
+	return c&cap != 0
+}
+
+func (c *Client) hasCapability(cap Capability) bool {
+	return c.capabilities.has(cap)
+}
+
+// helloMessage is the first control message on a liwords.v2 connection.
+type helloMessage struct {
+	Type     string `json:"type"`
+	Protocol string `json:"protocol"`
+	ConnID   string `json:"connID"`
+	// Capabilities are the ones the server supports; Enabled are the ones
+	// that are on for this connection.
+	Capabilities []string `json:"capabilities"`
+	Enabled      []string `json:"enabled"`
+}
+
+// sendControl queues a control message for the client. It is a no-op for
+// clients that don't understand control messages.
+func (c *Client) sendControl(msg interface{}) {
+	if !c.hasCapability(CapControl) {
+		return
+	}
+	bts, err := json.Marshal(msg)
+	if err != nil {
+		// This really shouldn't happen.
+		log.Err(err).Msg("error serializing control message")
+		return
+	}
+	c.enqueue(outboundFrame{data: bts, control: true})
+}
+
+func (c *Client) sendHello() {
+	c.sendControl(helloMessage{
+		Type:         "hello",
+		Protocol:     c.protocol,
+		ConnID:       c.connID,
+		Capabilities: c.hub.serverCapabilities(c).Names(),
+		Enabled:      c.capabilities.Names(),
+	})
+}
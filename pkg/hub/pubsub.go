@@ -1,181 +1,259 @@
 package sockets
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"strings"
 
 	nats "github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/woogles-io/liwords-socket/pkg/tracing"
 )
 
 // PubSub encapsulates the various subscriptions to the different channels.
 // The `liwords` package should have a very similar structure.
+//
+// Every subject we subscribe or publish to may be namespaced with a prefix,
+// so that several environments can share one NATS cluster. With a prefix of
+// "staging", we subscribe to staging.lobby.> and publish to staging.ipc.pb.*,
+// and the API must be configured to match. Subjects inside the hub never
+// carry the prefix; subject adds it and unprefixed strips it.
 type PubSub struct {
 	natsconn      *nats.Conn
+	prefix        string
 	topics        []string
 	subscriptions []*nats.Subscription
-	subchans      map[string]chan *nats.Msg
+	// interests are the subscriptions we hold for local clients; see
+	// interest.go.
+	interests map[string]*interestSub
+	// All subscriptions deliver to msgs.
+	msgs chan *nats.Msg
 }
 
-func newPubSub(natsURL string) (*PubSub, error) {
-	natsconn, err := nats.Connect(natsURL)
+func newPubSub(natsURL, prefix string, opts ...nats.Option) (*PubSub, error) {
+	if strings.ContainsAny(prefix, "*> \t\r\n") || strings.HasPrefix(prefix, ".") ||
+		strings.HasSuffix(prefix, ".") || strings.Contains(prefix, "..") {
+		return nil, fmt.Errorf("bad subject prefix %q", prefix)
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+
+	natsconn, err := nats.Connect(natsURL, opts...)
 
 	if err != nil {
 		return nil, err
 	}
 
+	// Lobby, connection, user, game, tournament, channel and chat messages
+	// are subscribed to only while a local client wants them; see
+	// interest.go. These are the topics every node needs.
 	topics := []string{
-		// lobby messages:
-		"lobby.>",
-		// for specific connections
-		"connid.>",
-		// user messages
-		"user.>",
-		// usertv messages; for when someone is watching a user's games
-		"usertv.>",
-		// gametv messages: for observer mode in a single game.
-		"gametv.>",
-		// private game messages: only for the players of a game.
-		"game.>",
-		// tourneys
-		"tournament.>",
-		// chats
-		"chat.>",
-		// generic channels
-		"channel.>",
+		// private messages. The subject names both users, so we can't
+		// subscribe by user.
+		"chat.pm.>",
+		// site-wide notices
+		"broadcast.>",
+		// ban list updates
+		"bans.>",
+		// realm cache invalidations
+		"realmcache.>",
 	}
 	pubSub := &PubSub{
 		natsconn:      natsconn,
+		prefix:        prefix,
 		topics:        topics,
 		subscriptions: []*nats.Subscription{},
-		subchans:      map[string]chan *nats.Msg{},
+		interests:     make(map[string]*interestSub),
+		msgs:          make(chan *nats.Msg, 512*(len(topics)+len(interestKinds))),
 	}
 	// Subscribe to the above topics.
 	for _, topic := range topics {
-		ch := make(chan *nats.Msg, 512)
-		sub, err := natsconn.ChanSubscribe(topic, ch)
+		sub, err := natsconn.ChanSubscribe(pubSub.subject(topic), pubSub.msgs)
 		if err != nil {
 			return nil, err
 		}
 		pubSub.subscriptions = append(pubSub.subscriptions, sub)
-		pubSub.subchans[topic] = ch
-
 	}
 	return pubSub, nil
 }
 
+// subject returns the subject as seen by NATS.
+func (ps *PubSub) subject(s string) string {
+	return ps.prefix + s
+}
+
+// unprefixed returns the subject as seen by the hub.
+func (ps *PubSub) unprefixed(s string) string {
+	return strings.TrimPrefix(s, ps.prefix)
+}
+
+// publish publishes data to the subject, under our prefix.
+func (ps *PubSub) publish(subject string, data []byte) error {
+	return ps.natsconn.Publish(ps.subject(subject), data)
+}
+
 // PubsubProcess processes pubsub messages.
 func (h *Hub) PubsubProcess() {
-	for {
-		select {
-		case msg := <-h.pubsub.subchans["lobby.>"]:
-			// Handle lobby message. If something is published to the lobby,
-			// let's just send it along to the correct sockets, we should not
-			// need to parse it.
-			log.Debug().Str("topic", msg.Subject).Msg("got lobby message, forwarding along")
-			subtopics := strings.Split(msg.Subject, ".")
-			if len(subtopics) < 2 {
-				log.Error().Msgf("subtopics weird %v", msg.Subject)
-				continue
-			}
-			h.sendToRealm(LobbyRealm, msg.Data)
+	for msg := range h.pubsub.msgs {
+		ctx, span := tracer.Start(tracing.Extract(context.Background(), msg), "deliver",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(attribute.String("messaging.destination.name", msg.Subject)))
+		// The message is ours alone, so routeMessage can have it as the
+		// hub sees it.
+		msg.Subject = h.pubsub.unprefixed(msg.Subject)
+		h.routeMessage(ctx, msg)
+		span.End()
+	}
+}
 
-		case msg := <-h.pubsub.subchans["tournament.>"]:
-			log.Debug().Str("topic", msg.Subject).Int("type", int(msg.Data[2])).Msg("got tournament message, forwarding along")
+// routeMessage forwards a pubsub message to the right sockets.
+func (h *Hub) routeMessage(ctx context.Context, msg *nats.Msg) {
+	switch strings.SplitN(msg.Subject, ".", 2)[0] {
+	case "lobby":
+		// Handle lobby message. If something is published to the lobby,
+		// let's just send it along to the correct sockets, we should not
+		// need to parse it.
+		log.Debug().Str("topic", msg.Subject).Msg("got lobby message, forwarding along")
+		subtopics := strings.Split(msg.Subject, ".")
+		if len(subtopics) < 2 {
+			log.Error().Msgf("subtopics weird %v", msg.Subject)
+			return
+		}
+		h.sendToRealm(ctx, LobbyRealm, msg.Data)
 
-			subtopics := strings.Split(msg.Subject, ".")
-			if len(subtopics) < 2 {
-				log.Error().Msgf("tournament subtopics weird %v", msg.Subject)
-				continue
-			}
-			tournamentID := subtopics[1]
-			h.sendToRealm(Realm("tournament-"+tournamentID), msg.Data)
-
-		case msg := <-h.pubsub.subchans["user.>"]:
-			// If we get a user message, we should send it along to the given
-			// user.
-			log.Debug().Str("topic", msg.Subject).Int("type", int(msg.Data[2])).Msg("got user message, forwarding along")
-			subtopics := strings.SplitN(msg.Subject, ".", 3)
-			if len(subtopics) < 2 {
-				log.Error().Msgf("user subtopics weird %v", msg.Subject)
-				continue
-			}
-			userID := subtopics[1]
-			if len(subtopics) < 3 {
-				h.sendToUser(userID, msg.Data)
-			} else {
-				h.sendToUserChannel(userID, msg.Data, subtopics[2])
-			}
+	case "tournament":
+		log.Debug().Str("topic", msg.Subject).Int("type", int(msg.Data[2])).Msg("got tournament message, forwarding along")
 
-		case msg := <-h.pubsub.subchans["connid.>"]:
-			// Forward to the given connection ID only.
-			log.Debug().Str("topic", msg.Subject).Int("type", int(msg.Data[2])).Msg("got connID message, forwarding along")
-			subtopics := strings.Split(msg.Subject, ".")
-			if len(subtopics) < 2 {
-				log.Error().Msgf("connid subtopics weird %v", msg.Subject)
-				continue
-			}
-			connID := subtopics[1]
-			h.sendToConnID(connID, msg.Data)
-
-		case msg := <-h.pubsub.subchans["usertv.>"]:
-			// XXX: This might not really work. We should only send to gametv
-			// and have something else follow the user across games.
-			// A usertv message is meant for people who are watching a user's games.
-			// Find the appropriate Realm.
-			log.Debug().Str("topic", msg.Subject).Msg("got usertv message, forwarding along")
-			subtopics := strings.Split(msg.Subject, ".")
-			if len(subtopics) < 2 {
-				log.Error().Msgf("usertv subtopics weird %v", msg.Subject)
-				continue
-			}
-			userID := subtopics[1]
-			h.sendToRealm(Realm("usertv-"+userID), msg.Data)
-
-		case msg := <-h.pubsub.subchans["gametv.>"]:
-			// A gametv message is meant for people who are observing a user's games.
-			log.Debug().Str("topic", msg.Subject).Msg("got gametv message, forwarding along")
-			subtopics := strings.Split(msg.Subject, ".")
-			if len(subtopics) < 2 {
-				log.Error().Msgf("gametv subtopics weird %v", msg.Subject)
-				continue
-			}
-			gameID := subtopics[1]
-			h.sendToRealm(Realm("gametv-"+gameID), msg.Data)
-
-		case msg := <-h.pubsub.subchans["game.>"]:
-			// A game message is meant for people who are playing a game.
-			log.Debug().Str("topic", msg.Subject).Msg("got game message, forwarding along")
-			subtopics := strings.Split(msg.Subject, ".")
-			if len(subtopics) < 2 {
-				log.Error().Msgf("gametv subtopics weird %v", msg.Subject)
-				continue
-			}
-			gameID := subtopics[1]
-			h.sendToRealm(Realm("game-"+gameID), msg.Data)
-
-		case msg := <-h.pubsub.subchans["chat.>"]:
-			log.Debug().Str("topic", msg.Subject).Msg("chat-msg")
-			if strings.HasPrefix(msg.Subject, "chat.pm.") {
-				// This is a private message. Send to each recipient.
-				recipients := strings.Split(strings.TrimPrefix(msg.Subject, "chat.pm."), "_")
-				log.Debug().Interface("recipients", recipients).Msg("private-message")
-				for _, r := range recipients {
-					h.sendToUser(r, msg.Data)
-				}
-			} else {
-				h.sendToRealm(channelToRealm(msg.Subject), msg.Data)
-			}
+		subtopics := strings.Split(msg.Subject, ".")
+		if len(subtopics) < 2 {
+			log.Error().Msgf("tournament subtopics weird %v", msg.Subject)
+			return
+		}
+		tournamentID := subtopics[1]
+		h.sendToRealm(ctx, Realm("tournament-"+tournamentID), msg.Data)
+
+	case "user":
+		// If we get a user message, we should send it along to the given
+		// user.
+		log.Debug().Str("topic", msg.Subject).Int("type", int(msg.Data[2])).Msg("got user message, forwarding along")
+		subtopics := strings.SplitN(msg.Subject, ".", 3)
+		if len(subtopics) < 2 {
+			log.Error().Msgf("user subtopics weird %v", msg.Subject)
+			return
+		}
+		userID := subtopics[1]
+		if len(subtopics) < 3 {
+			h.sendToUser(ctx, userID, msg.Data)
+		} else {
+			h.sendToUserChannel(ctx, userID, msg.Data, subtopics[2])
+		}
+
+	case "connid":
+		// Forward to the given connection ID only.
+		log.Debug().Str("topic", msg.Subject).Int("type", int(msg.Data[2])).Msg("got connID message, forwarding along")
+		subtopics := strings.Split(msg.Subject, ".")
+		if len(subtopics) < 2 {
+			log.Error().Msgf("connid subtopics weird %v", msg.Subject)
+			return
+		}
+		connID := subtopics[1]
+		h.sendToConnID(ctx, connID, msg.Data)
+
+	case "usertv":
+		// XXX: This might not really work. We should only send to gametv
+		// and have something else follow the user across games.
+		// A usertv message is meant for people who are watching a user's games.
+		// Find the appropriate Realm.
+		log.Debug().Str("topic", msg.Subject).Msg("got usertv message, forwarding along")
+		subtopics := strings.Split(msg.Subject, ".")
+		if len(subtopics) < 2 {
+			log.Error().Msgf("usertv subtopics weird %v", msg.Subject)
+			return
+		}
+		userID := subtopics[1]
+		h.sendToRealm(ctx, Realm("usertv-"+userID), msg.Data)
+
+	case "gametv":
+		// A gametv message is meant for people who are observing a user's games.
+		log.Debug().Str("topic", msg.Subject).Msg("got gametv message, forwarding along")
+		subtopics := strings.Split(msg.Subject, ".")
+		if len(subtopics) < 2 {
+			log.Error().Msgf("gametv subtopics weird %v", msg.Subject)
+			return
+		}
+		gameID := subtopics[1]
+		h.sendToRealm(ctx, Realm("gametv-"+gameID), msg.Data)
+
+	case "game":
+		// A game message is meant for people who are playing a game.
+		log.Debug().Str("topic", msg.Subject).Msg("got game message, forwarding along")
+		subtopics := strings.Split(msg.Subject, ".")
+		if len(subtopics) < 2 {
+			log.Error().Msgf("gametv subtopics weird %v", msg.Subject)
+			return
+		}
+		gameID := subtopics[1]
+		h.sendToRealm(ctx, Realm("game-"+gameID), msg.Data)
 
-		case msg := <-h.pubsub.subchans["channel.>"]:
-			log.Debug().Str("topic", msg.Subject).Msg("channel-msg")
-			subtopics := strings.Split(msg.Subject, ".")
-			if len(subtopics) < 2 {
-				log.Error().Msgf("channel subtopics weird %v", msg.Subject)
-				continue
+	case "chat":
+		log.Debug().Str("topic", msg.Subject).Msg("chat-msg")
+		if strings.HasPrefix(msg.Subject, "chat.pm.") {
+			// This is a private message. Send to each recipient.
+			recipients := strings.Split(strings.TrimPrefix(msg.Subject, "chat.pm."), "_")
+			log.Debug().Interface("recipients", recipients).Msg("private-message")
+			for _, r := range recipients {
+				h.sendToUser(ctx, r, msg.Data)
 			}
-			channelID := subtopics[1]
-			h.sendToRealm(Realm("channel-"+channelID), msg.Data)
+		} else {
+			h.sendToRealm(ctx, channelToRealm(msg.Subject), msg.Data)
+		}
+
+	case "channel":
+		log.Debug().Str("topic", msg.Subject).Msg("channel-msg")
+		subtopics := strings.Split(msg.Subject, ".")
+		if len(subtopics) < 2 {
+			log.Error().Msgf("channel subtopics weird %v", msg.Subject)
+			return
 		}
+		channelID := subtopics[1]
+		h.sendToRealm(ctx, Realm("channel-"+channelID), msg.Data)
 
+	case "broadcast":
+		log.Debug().Str("topic", msg.Subject).Msg("broadcast-msg")
+		if msg.Subject == "broadcast."+permissionProbe {
+			// Another node starting up; see natsperms.go.
+			return
+		}
+		audience, realmPrefix, err := parseNoticeSubject(msg.Subject)
+		if err != nil {
+			log.Err(err).Msgf("broadcast subtopics weird %v", msg.Subject)
+			return
+		}
+		notice := Notice{}
+		if err := json.Unmarshal(msg.Data, &notice); err != nil {
+			log.Err(err).Str("topic", msg.Subject).Msg("bad-notice")
+			return
+		}
+		h.sendNotice(noticeMessage{audience: audience, realmPrefix: realmPrefix, notice: notice})
+
+	case "bans":
+		subtopics := strings.Split(msg.Subject, ".")
+		if len(subtopics) != 2 {
+			log.Error().Msgf("bans subtopics weird %v", msg.Subject)
+			return
+		}
+		h.handleBanUpdate(subtopics[1], msg.Data)
+
+	case "realmcache":
+		if msg.Subject != "realmcache.invalidate" {
+			log.Error().Msgf("realmcache subtopics weird %v", msg.Subject)
+			return
+		}
+		h.handleRealmCacheInvalidation(msg.Data)
 	}
 }
@@ -0,0 +1,95 @@
+package sockets
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+func TestSubjectPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		prefix      string
+		subject     string
+		natsSubject string
+	}{
+		{"", "game.g1", "game.g1"},
+		{"prod", "game.g1", "prod.game.g1"},
+		{"eu.prod", "ipc.pb.joinRealm", "eu.prod.ipc.pb.joinRealm"},
+	} {
+		ps := &PubSub{prefix: tc.prefix}
+		if tc.prefix != "" {
+			ps.prefix += "."
+		}
+		if got := ps.subject(tc.subject); got != tc.natsSubject {
+			t.Errorf("prefix %q: subject(%q) = %q, want %q", tc.prefix, tc.subject, got, tc.natsSubject)
+		}
+		if got := ps.unprefixed(tc.natsSubject); got != tc.subject {
+			t.Errorf("prefix %q: unprefixed(%q) = %q, want %q", tc.prefix, tc.natsSubject, got, tc.subject)
+		}
+	}
+}
+
+func TestNewPubSubPrefix(t *testing.T) {
+	ns := newTestNats(t)
+	for _, prefix := range []string{"", "prod", "eu.prod", "staging-2"} {
+		ps, err := newPubSub(ns.ClientURL(), prefix)
+		if err != nil {
+			t.Errorf("newPubSub(%q): %v", prefix, err)
+			continue
+		}
+		ps.natsconn.Close()
+	}
+	for _, prefix := range []string{"*", "prod.>", "pr od", "prod\n", ".prod", "prod.", "eu..prod"} {
+		// The prefix is checked before connecting, so the URL doesn't
+		// matter.
+		_, err := newPubSub("nats://127.0.0.1:1", prefix)
+		if err == nil || !strings.Contains(err.Error(), "bad subject prefix") {
+			t.Errorf("newPubSub(%q) = %v, want a bad prefix error", prefix, err)
+		}
+	}
+}
+
+// A node only hears its own environment, even when a publisher for another
+// one uses the same subjects.
+func TestPrefixRouting(t *testing.T) {
+	ns := newTestNats(t)
+	h := newTestHub(t, ns, "-nats-subject-prefix", "prod")
+	go h.Run()
+	c := newTestClient(h, "u1", "c1", "game-x")
+	h.register <- c
+	if n := connCount(h); n != 1 {
+		t.Fatalf("hub has %d clients, want 1", n)
+	}
+	if err := h.pubsub.natsconn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	for subject, data := range map[string]string{
+		"staging.game.x": "staging",
+		"game.x":         "unprefixed",
+	} {
+		if err := pub.Publish(subject, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Published last, so once it arrives the others would have too.
+	if err := pub.Publish("prod.game.x", []byte("prod")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case f := <-c.send:
+		if got := string(f.data); got != "prod" {
+			t.Fatalf("client got %q, want only prod", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client never got prod.game.x")
+	}
+}
@@ -0,0 +1,218 @@
+package sockets
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Connection quality goes beyond avglag: over the last qualityWindow pings
+// we keep the round trip times, from which we get the jitter, and whether
+// each ping was answered before the next one went out. Along with how often
+// the user has reconnected lately, these make a score from 0 to 100. The
+// client gets it as a quality control message, for a UI indicator, and the
+// backend gets it on qualitySubject, so it can tell when a game was played
+// over a bad connection. Both get it every qualityReportPongs pongs; the
+// client also gets it as soon as the rating changes, and the backend gets a
+// last one when the connection closes.
+//
+// A reconnect is a connect that follows one of the user's disconnects
+// within reconnectWindow; each disconnect pairs with at most one connect.
+// Opening more tabs doesn't count against anyone.
+//
+// SSE has no pings, so SSE clients have no score.
+
+const (
+	qualityWindow      = 20
+	qualityReportPongs = 6
+	// reconnectWindow is how far back we count a user's reconnects.
+	reconnectWindow = 10 * time.Minute
+	// qualitySubject is where reports go. Every other IPC message is a
+	// protobuf on ipc.pb, but the ipc protos belong to the liwords repo and
+	// have no message for this yet, so until one is added the report is
+	// JSON, on its own tree so that no ipc.pb consumer tries to decode it.
+	qualitySubject = "ipc.json.connQuality"
+)
+
+// connQuality is a client's connection quality report.
+type connQuality struct {
+	Type       string  `json:"type"`
+	Score      int     `json:"score"`
+	Rating     string  `json:"rating"`
+	RTTMs      int64   `json:"rttMs"`
+	JitterMs   int64   `json:"jitterMs"`
+	Loss       float64 `json:"loss"`
+	Reconnects int     `json:"reconnects"`
+	Samples    int     `json:"samples"`
+}
+
+// pingSent records that a ping went out at now. The caller must hold the
+// client's lock.
+func (c *Client) pingSent(now time.Time) {
+	if c.pingsSent > 0 {
+		c.answered[(c.pingsSent-1)%qualityWindow] = !c.awaitingPong
+	}
+	c.pingsSent++
+	c.awaitingPong = true
+	c.lastPingSent = now
+}
+
+// pongReceived records a round trip. The caller must hold the client's
+// lock.
+func (c *Client) pongReceived(rtt time.Duration) {
+	c.rtts[c.pongCount%qualityWindow] = rtt
+	c.awaitingPong = false
+}
+
+// quality works out the client's connection quality. The caller must hold
+// the client's lock, at least for reading.
+func (c *Client) quality() connQuality {
+	q := connQuality{Type: "quality", Reconnects: c.recentReconnects}
+
+	n := min(c.pongCount, qualityWindow)
+	q.Samples = n
+	if n > 0 {
+		// The samples are in a ring; walk it oldest first.
+		start := c.pongCount - n
+		var sum, jitter time.Duration
+		for i := 0; i < n; i++ {
+			rtt := c.rtts[(start+i)%qualityWindow]
+			sum += rtt
+			if i > 0 {
+				d := rtt - c.rtts[(start+i-1)%qualityWindow]
+				if d < 0 {
+					d = -d
+				}
+				jitter += d
+			}
+		}
+		q.RTTMs = (sum / time.Duration(n)).Milliseconds()
+		if n > 1 {
+			q.JitterMs = (jitter / time.Duration(n-1)).Milliseconds()
+		}
+	}
+
+	// The last ping's answer may still be on its way, so it doesn't
+	// count yet.
+	if judged := min(c.pingsSent-1, qualityWindow); judged > 0 {
+		missed := 0
+		for i := 0; i < judged; i++ {
+			if !c.answered[i] {
+				missed++
+			}
+		}
+		q.Loss = float64(missed) / float64(judged)
+	}
+
+	penalty := min(max(q.RTTMs-100, 0)/10, 40) +
+		min(q.JitterMs/5, 20) +
+		min(int64(q.Loss*150), 30) +
+		min(int64(q.Reconnects)*5, 10)
+	q.Score = 100 - int(penalty)
+	switch {
+	case q.Score >= 80:
+		q.Rating = "good"
+	case q.Score >= 50:
+		q.Rating = "fair"
+	default:
+		q.Rating = "poor"
+	}
+	return q
+}
+
+// reportQuality sends the client its quality when it is due, or when the
+// rating has changed, and publishes it to the backend when due. It is
+// called after every pong.
+func (c *Client) reportQuality() {
+	c.Lock()
+	q := c.quality()
+	due := c.pongCount%qualityReportPongs == 0
+	changed := q.Rating != c.lastRating
+	c.lastRating = q.Rating
+	c.Unlock()
+
+	if due || changed {
+		c.sendControl(q)
+	}
+	if due {
+		c.hub.publishQuality(c, q)
+	}
+}
+
+// publishQuality sends a quality report to the backend.
+func (h *Hub) publishQuality(c *Client, q connQuality) {
+	data, err := json.Marshal(q)
+	if err != nil {
+		log.Err(err).Msg("error serializing quality")
+		return
+	}
+	if err := h.pubsub.publish(extendTopic(c, qualitySubject), data); err != nil {
+		log.Err(err).Str("connID", c.connID).Msg("publish-quality")
+	}
+}
+
+// connHistory is when a user disconnected and reconnected lately.
+type connHistory struct {
+	disconnects []time.Time
+	reconnects  []time.Time
+}
+
+// prune forgets what is too old to count, and says whether anything is
+// left.
+func (ch *connHistory) prune(now time.Time) bool {
+	ch.disconnects = pruneConnects(ch.disconnects, now)
+	ch.reconnects = pruneConnects(ch.reconnects, now)
+	return len(ch.disconnects) > 0 || len(ch.reconnects) > 0
+}
+
+func (h *Hub) connHistory(userID string) *connHistory {
+	ch := h.recentConnects[userID]
+	if ch == nil {
+		ch = &connHistory{}
+		h.recentConnects[userID] = ch
+	}
+	return ch
+}
+
+// countDisconnect notes that one of the client's user's connections went
+// away. It is called from Run.
+func (h *Hub) countDisconnect(c *Client) {
+	ch := h.connHistory(c.userID)
+	ch.disconnects = append(ch.disconnects, time.Now())
+}
+
+// countReconnect counts the client's connect as a reconnect if its user
+// disconnected lately, and tells the client how many times the user
+// reconnected. It is called from Run.
+func (h *Hub) countReconnect(c *Client) {
+	now := time.Now()
+	ch := h.connHistory(c.userID)
+	ch.prune(now)
+	if len(ch.disconnects) > 0 {
+		ch.disconnects = ch.disconnects[1:]
+		ch.reconnects = append(ch.reconnects, now)
+	}
+	c.Lock()
+	c.recentReconnects = len(ch.reconnects)
+	c.Unlock()
+}
+
+// pruneRecentConnects forgets disconnects and reconnects that are too old
+// to count. It is called from Run.
+func (h *Hub) pruneRecentConnects() {
+	now := time.Now()
+	for userID, ch := range h.recentConnects {
+		if !ch.prune(now) {
+			delete(h.recentConnects, userID)
+		}
+	}
+}
+
+func pruneConnects(connects []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(connects) && now.Sub(connects[i]) > reconnectWindow {
+		i++
+	}
+	return connects[i:]
+}
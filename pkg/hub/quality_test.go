@@ -0,0 +1,61 @@
+package sockets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectsNeedADisconnect(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	reconnects := func(c *Client) int {
+		c.RLock()
+		defer c.RUnlock()
+		return c.recentReconnects
+	}
+
+	// Three tabs at once are not a flaky connection.
+	tabs := []*Client{
+		newTestClient(h, "u1", "c1", "lobby"),
+		newTestClient(h, "u1", "c2", "lobby"),
+		newTestClient(h, "u1", "c3", "lobby"),
+	}
+	for _, c := range tabs {
+		if err := h.addClient(c); err != nil {
+			t.Fatal(err)
+		}
+		if n := reconnects(c); n != 0 {
+			t.Errorf("%s: %d reconnects, want 0", c.connID, n)
+		}
+	}
+
+	// One of them drops and comes back.
+	h.removeClient(tabs[0])
+	back := newTestClient(h, "u1", "c4", "lobby")
+	if err := h.addClient(back); err != nil {
+		t.Fatal(err)
+	}
+	if n := reconnects(back); n != 1 {
+		t.Errorf("after a drop: %d reconnects, want 1", n)
+	}
+
+	// That disconnect has been paired up, so another tab is no reconnect
+	// either.
+	another := newTestClient(h, "u1", "c5", "lobby")
+	if err := h.addClient(another); err != nil {
+		t.Fatal(err)
+	}
+	if n := reconnects(another); n != 1 {
+		t.Errorf("another tab: %d reconnects, want 1", n)
+	}
+
+	// A disconnect from before the window doesn't count.
+	h.recentConnects["u1"].disconnects = []time.Time{time.Now().Add(-reconnectWindow - time.Minute)}
+	h.recentConnects["u1"].reconnects = nil
+	late := newTestClient(h, "u1", "c6", "lobby")
+	if err := h.addClient(late); err != nil {
+		t.Fatal(err)
+	}
+	if n := reconnects(late); n != 0 {
+		t.Errorf("after an old drop: %d reconnects, want 0", n)
+	}
+}
@@ -0,0 +1,143 @@
+package sockets
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The realms for a (path, user ID) rarely change from one second to the
+// next, and reconnect storms ask for the same ones over and over, so we
+// cache registerRealm responses for a little while. The API publishes to
+// realmcache.invalidate when the answer may have changed, e.g. when a
+// game's players or a tournament's members change. The payload is a JSON
+// realmCacheInvalidation:
+//
+//	{"path": "/game/abc"}                 forget the path, for every user
+//	{"userID": "xyz"}                     forget every path, for the user
+//	{"path": "/game/abc", "userID": "xyz"}  forget just the one entry
+//	{}                                    forget everything
+//
+// An invalidation can arrive while a registerRealm request is in flight,
+// with the answer computed before the change. So that answer isn't cached
+// after the fact, every invalidation bumps the cache's generation, and put
+// only stores an answer if the generation hasn't moved since the request
+// went out.
+
+var realmCacheStats = expvar.NewMap("realm-cache")
+
+type realmCacheKey struct {
+	path   string
+	userID string
+}
+
+type realmCacheEntry struct {
+	realms  []string
+	expires time.Time
+}
+
+type realmCacheInvalidation struct {
+	Path   string `json:"path"`
+	UserID string `json:"userID"`
+}
+
+type realmCache struct {
+	sync.Mutex
+	ttl       time.Duration
+	entries   map[realmCacheKey]realmCacheEntry
+	lastSweep time.Time
+	// gen counts invalidations.
+	gen uint64
+}
+
+// newRealmCache returns a cache whose entries last for ttl. A ttl of 0
+// turns caching off.
+func newRealmCache(ttl time.Duration) *realmCache {
+	return &realmCache{
+		ttl:     ttl,
+		entries: make(map[realmCacheKey]realmCacheEntry),
+	}
+}
+
+func (rc *realmCache) get(path, userID string) ([]string, bool) {
+	if rc.ttl <= 0 {
+		return nil, false
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	e, ok := rc.entries[realmCacheKey{path, userID}]
+	if !ok || time.Now().After(e.expires) {
+		realmCacheStats.Add("misses", 1)
+		return nil, false
+	}
+	realmCacheStats.Add("hits", 1)
+	return append([]string(nil), e.realms...), true
+}
+
+// generation returns the current generation, to pass to put once the
+// realms have been fetched.
+func (rc *realmCache) generation() uint64 {
+	rc.Lock()
+	defer rc.Unlock()
+	return rc.gen
+}
+
+// put caches the realms, unless the cache was invalidated since gen.
+func (rc *realmCache) put(path, userID string, realms []string, gen uint64) {
+	if rc.ttl <= 0 {
+		return
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	if gen != rc.gen {
+		realmCacheStats.Add("stale", 1)
+		return
+	}
+	now := time.Now()
+	// Every so often, drop whatever has expired so the map doesn't grow
+	// without bound.
+	if now.Sub(rc.lastSweep) > rc.ttl {
+		for k, e := range rc.entries {
+			if now.After(e.expires) {
+				delete(rc.entries, k)
+			}
+		}
+		rc.lastSweep = now
+	}
+	rc.entries[realmCacheKey{path, userID}] = realmCacheEntry{
+		realms:  append([]string(nil), realms...),
+		expires: now.Add(rc.ttl),
+	}
+}
+
+func (rc *realmCache) invalidate(inv realmCacheInvalidation) int {
+	rc.Lock()
+	defer rc.Unlock()
+	// Even if nothing matches, a request in flight may be about to put
+	// something that would have.
+	rc.gen++
+	n := 0
+	for k := range rc.entries {
+		if (inv.Path == "" || k.path == inv.Path) && (inv.UserID == "" || k.userID == inv.UserID) {
+			delete(rc.entries, k)
+			n++
+		}
+	}
+	realmCacheStats.Add("invalidated", int64(n))
+	return n
+}
+
+// handleRealmCacheInvalidation is called from PubsubProcess.
+func (h *Hub) handleRealmCacheInvalidation(data []byte) {
+	var inv realmCacheInvalidation
+	if err := json.Unmarshal(data, &inv); err != nil {
+		log.Err(err).Msg("bad-realm-cache-invalidation")
+		return
+	}
+	n := h.realmCache.invalidate(inv)
+	log.Debug().Str("path", inv.Path).Str("userID", inv.UserID).Int("entries", n).
+		Msg("realm-cache-invalidated")
+}
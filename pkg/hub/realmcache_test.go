@@ -0,0 +1,65 @@
+package sockets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRealmCacheInvalidate(t *testing.T) {
+	rc := newRealmCache(time.Minute)
+	rc.put("/game/a", "u1", []string{"game-a"}, rc.generation())
+	rc.put("/game/a", "u2", []string{"gametv-a"}, rc.generation())
+	rc.put("/game/b", "u1", []string{"game-b"}, rc.generation())
+
+	if n := rc.invalidate(realmCacheInvalidation{Path: "/game/a"}); n != 2 {
+		t.Errorf("invalidated %d entries, want 2", n)
+	}
+	if _, ok := rc.get("/game/a", "u1"); ok {
+		t.Error("/game/a is still cached for u1")
+	}
+	if realms, ok := rc.get("/game/b", "u1"); !ok || realms[0] != "game-b" {
+		t.Errorf("/game/b = %v, %v; want game-b", realms, ok)
+	}
+}
+
+// An answer fetched before an invalidation must not be cached after it.
+func TestRealmCacheStalePut(t *testing.T) {
+	rc := newRealmCache(time.Minute)
+
+	gen := rc.generation()
+	// The request is in flight when the players change. Nothing is cached
+	// yet for the invalidation to remove.
+	if n := rc.invalidate(realmCacheInvalidation{Path: "/game/a"}); n != 0 {
+		t.Errorf("invalidated %d entries, want 0", n)
+	}
+	rc.put("/game/a", "u1", []string{"gametv-a"}, gen)
+	if realms, ok := rc.get("/game/a", "u1"); ok {
+		t.Errorf("stale answer %v was cached", realms)
+	}
+
+	rc.put("/game/a", "u1", []string{"game-a"}, rc.generation())
+	if _, ok := rc.get("/game/a", "u1"); !ok {
+		t.Error("fresh answer was not cached")
+	}
+}
+
+// Invalidations published while NATS was down never arrived, so the cache
+// must be cleared when it comes back.
+func TestRealmCacheClearedOnNatsRestore(t *testing.T) {
+	h := newTestHub(t, newTestNats(t))
+	rc := h.realmCache
+
+	rc.put("/game/a", "u1", []string{"game-a"}, rc.generation())
+	h.natsStateChanged(false)
+	// A request that was answered just before the outage.
+	gen := rc.generation()
+	h.natsStateChanged(true)
+
+	if realms, ok := rc.get("/game/a", "u1"); ok {
+		t.Errorf("/game/a is still cached as %v", realms)
+	}
+	rc.put("/game/b", "u1", []string{"game-b"}, gen)
+	if realms, ok := rc.get("/game/b", "u1"); ok {
+		t.Errorf("an answer from before the restore was cached as %v", realms)
+	}
+}
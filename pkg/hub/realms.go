@@ -0,0 +1,93 @@
+package sockets
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math/rand/v2"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Realm registration asks the liwords API which realms a path maps to, so it
+// can be slow, or fail outright if the API is down. It happens in the
+// background once the connection is up, so it never holds up the HTTP
+// handler. Until it is done the client is pending: its pumps run, but it
+// gets no broadcasts, and what it sends is held until it is registered; see
+// lifecycle.go.
+//
+// Failed attempts are retried with jittered exponential backoff. If they all
+// fail the client is degraded rather than dropped: it joins just the lobby,
+// may not send anything, and gets a notice asking it to reconnect later.
+
+const (
+	realmRetryBase = 250 * time.Millisecond
+	realmRetryMax  = 4 * time.Second
+	// degradedReconnectAfter is how soon degraded clients are asked to try
+	// again.
+	degradedReconnectAfter = 30 * time.Second
+)
+
+var (
+	errDegraded      = errors.New("the server is having trouble; try again later")
+	errNotRegistered = errors.New("still connecting; try again in a moment")
+)
+
+var realmRegistrations = expvar.NewMap("realm-registrations")
+
+// registerAsync registers the client's realms and then hands it to the hub.
+// ctx should not be cancelled when the HTTP handler returns.
+func (h *Hub) registerAsync(ctx context.Context, c *Client, path string) {
+	var err error
+	for attempt := 0; attempt <= h.cfg.RealmRetries; attempt++ {
+		if attempt > 0 {
+			realmRegistrations.Add("retries", 1)
+			time.Sleep(realmRetryDelay(attempt))
+		}
+		if c.currentState() != statePending {
+			// It went away while we were waiting.
+			return
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, h.cfg.RealmTimeout)
+		err = registerRealm(attemptCtx, c, path, h)
+		cancel()
+		if err == nil {
+			realmRegistrations.Add("ok", 1)
+			h.register <- c
+			return
+		}
+		log.Err(err).Str("connID", c.connID).Str("path", path).Int("attempt", attempt).
+			Msg("register-realm-error")
+	}
+	realmRegistrations.Add("degraded", 1)
+	h.degrade(c)
+	h.register <- c
+}
+
+func realmRetryDelay(attempt int) time.Duration {
+	d := realmRetryBase << (attempt - 1)
+	if d > realmRetryMax || d <= 0 {
+		d = realmRetryMax
+	}
+	// Full jitter, so a storm of reconnects doesn't retry in lockstep.
+	return time.Duration(rand.Int64N(int64(d))) + 1
+}
+
+// degrade puts the client in the lobby, read-only, and tells it why.
+func (h *Hub) degrade(c *Client) {
+	c.degraded.Store(true)
+	c.tempRealms = []string{string(LobbyRealm)}
+	reconnectAt := time.Now().Add(degradedReconnectAfter)
+	control, legacy, err := noticeFrames(Notice{
+		Kind:        "degraded",
+		Message:     "We are having trouble reaching the server. Some features are unavailable; please reload in a little while.",
+		ReconnectAt: &reconnectAt,
+	})
+	if err != nil {
+		log.Err(err).Msg("error serializing notice")
+		return
+	}
+	c.enqueue(c.pickNoticeFrame(control, legacy))
+	log.Warn().Str("connID", c.connID).Str("username", c.username).Msg("client-degraded")
+}
@@ -0,0 +1,257 @@
+package sockets
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The SSE transport is a fallback for networks that block websockets.
+// Downstream messages go out over a long-lived Server-Sent Events stream
+// (GET /sse), and upstream messages come in as plain POSTs (POST /sse/send).
+//
+// The first event on the stream is a `session` event whose data is an
+// unguessable session ID. The client must pass it back as the `session`
+// query parameter on every POST so that we can tie the upstream message to
+// the right Client; the POSTs must come from the stream's Origin. Every
+// other event is a `message` event whose data is the base64-encoded binary
+// frame, exactly as it would have been sent over the websocket. Clients that
+// pass protocol=liwords.v2 also get `control` events holding control
+// messages, starting with the hello.
+
+func newSessionID() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (h *Hub) addSSESession(id string, c *Client) {
+	h.sseMutex.Lock()
+	defer h.sseMutex.Unlock()
+	h.sseSessions[id] = c
+}
+
+func (h *Hub) removeSSESession(id string) {
+	h.sseMutex.Lock()
+	defer h.sseMutex.Unlock()
+	delete(h.sseSessions, id)
+}
+
+func (h *Hub) sseSession(id string) *Client {
+	h.sseMutex.Lock()
+	defer h.sseMutex.Unlock()
+	return h.sseSessions[id]
+}
+
+// ServeSSE handles the downstream half of the SSE transport. The stream
+// stays open for as long as the client is connected, so this blocks.
+func ServeSSE(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	ip := hub.proxies.clientIP(r)
+	log.Debug().Str("ip", ip).Msg("servesse-new-conn")
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	path, connID, err := connParams(r)
+	if err != nil {
+		log.Error().Msg(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client := &Client{
+		hub:          hub,
+		transport:    transportSSE,
+		sseOrigin:    r.Header.Get("Origin"),
+		protocol:     protocolV1,
+		capabilities: CapBatching,
+		send:         make(chan outboundFrame, 256),
+		connToken:    hub.requestToken(r),
+		ip:           ip,
+		connectedAt:  time.Now(),
+	}
+
+	if r.URL.Query().Get("protocol") == protocolV2 {
+		client.protocol = protocolV2
+		client.capabilities |= CapControl
+	}
+
+	if aerr := hub.admit(r.Context(), client, connID); aerr != nil {
+		http.Error(w, aerr.Error(), aerr.status)
+		return
+	}
+	// Once the stream is open, the hub releases the client when it goes.
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			hub.limiter.release(client)
+		}
+	}()
+
+	sessionID, err := newSessionID()
+	if err != nil {
+		log.Err(err).Msg("sse-session-id")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx and friends from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := io.WriteString(w, "event: session\ndata: "+sessionID+"\n\n"); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		// The ResponseWriter can't stream; there is nothing we can do.
+		log.Err(err).Msg("sse-flush-unsupported")
+		return
+	}
+
+	hub.addSSESession(sessionID, client)
+	defer hub.removeSSESession(sessionID)
+
+	client.sendHello()
+	handedOff = true
+	go hub.registerAsync(context.WithoutCancel(r.Context()), client, path)
+	defer func() {
+		hub.unregister <- client
+	}()
+
+	log.Debug().Str("connID", client.connID).Msg("sse-stream-open")
+	client.ssePump(r, w, rc)
+	log.Debug().Str("connID", client.connID).Msg("sse-stream-closed")
+}
+
+// ssePump pumps messages from the hub to the event stream. It is the SSE
+// counterpart of writePump, and likewise the only writer to the stream.
+func (c *Client) ssePump(r *http.Request, w http.ResponseWriter, rc *http.ResponseController) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	var buf bytes.Buffer
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case frame, ok := <-c.send:
+			if !ok {
+				// The hub closed the channel.
+				rc.SetWriteDeadline(time.Now().Add(writeWait))
+				io.WriteString(w, "event: close\ndata: "+c.closeReason+"\n\n")
+				rc.Flush()
+				return
+			}
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			if frame.control {
+				if _, err := io.WriteString(w, "event: control\ndata: "+string(frame.data)+"\n\n"); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+				continue
+			}
+			// Coalesce queued messages into a single event, like writePump
+			// does for websocket messages. A control frame ends the batch.
+			buf.Reset()
+			buf.Write(frame.data)
+			var control *outboundFrame
+			n := len(c.send)
+			for i := 0; i < n; i++ {
+				frame, ok := <-c.send
+				if !ok {
+					break
+				}
+				if frame.control {
+					control = &frame
+					break
+				}
+				buf.Write(frame.data)
+			}
+			_, err := io.WriteString(w, "data: "+base64.StdEncoding.EncodeToString(buf.Bytes())+"\n\n")
+			if err != nil {
+				return
+			}
+			if control != nil {
+				if _, err := io.WriteString(w, "event: control\ndata: "+string(control.data)+"\n\n"); err != nil {
+					return
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			// A comment line keeps proxies from timing out an idle stream.
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ServeSSESend handles the upstream half of the SSE transport. The body is a
+// single binary frame, in the same format a websocket client would send.
+func ServeSSESend(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	client := hub.sseSession(r.URL.Query().Get("session"))
+	if client == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Origin") != client.sseOrigin {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	msg, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if len(msg) > maxMessageSize {
+		http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	err = hub.parseAndExecuteMessage(r.Context(), msg, client)
+	if errors.Is(err, errMessageTooShort) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Err(err).Str("username", client.username).Msg("sse-parse-and-execute-message")
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,235 @@
+package sockets
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"github.com/rs/zerolog/log"
+)
+
+// The WebTransport transport is experimental. It exists for players on lossy
+// mobile links, where head-of-line blocking on a TCP websocket shows up as lag.
+//
+// After the session is established the client opens a single bidirectional
+// stream, which carries the same binary frames as the websocket in both
+// directions. Frames are self-delimiting thanks to their two-byte length
+// header, so the stream is just the frames back to back.
+//
+// Lag probes go over datagrams instead, so that a lost packet on the stream
+// doesn't hold up the measurement. Every pingPeriod the server sends an
+// 8-byte datagram holding the send time; the client echoes it back verbatim.
+
+// WebTransport session error codes.
+const (
+	wtCodeNormal      webtransport.SessionErrorCode = 0
+	wtCodeLoginFailed webtransport.SessionErrorCode = 1
+	wtCodeNoStream    webtransport.SessionErrorCode = 3
+	wtCodeBadFrame    webtransport.SessionErrorCode = 4
+	wtCodeHubClosed   webtransport.SessionErrorCode = 5
+)
+
+const (
+	// Length of the two-byte length header at the start of every frame.
+	frameHeaderLen = 2
+	// Length of a lag probe datagram.
+	lagProbeLen = 8
+	// Time allowed for the client to open its message stream.
+	wtStreamAcceptWait = 10 * time.Second
+)
+
+// NewWebTransportServer returns a WebTransport server that serves sessions at
+// /wt on the given UDP address.
+func NewWebTransportServer(hub *Hub, addr string, cert tls.Certificate) *webtransport.Server {
+	router := http.NewServeMux()
+	wt := &webtransport.Server{
+		H3: &http3.Server{
+			Addr:      addr,
+			Handler:   router,
+			TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+			QUICConfig: &quic.Config{
+				// QUIC keepalives and idle timeouts stand in for the
+				// websocket ping/pong deadline.
+				KeepAlivePeriod: pingPeriod,
+				MaxIdleTimeout:  pongWait,
+			},
+		},
+		CheckOrigin: checkOrigin,
+	}
+	webtransport.ConfigureHTTP3Server(wt.H3)
+
+	router.Handle("/wt", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWebTransport(hub, wt, w, r)
+	}))
+	return wt
+}
+
+// ServeWebTransport handles WebTransport session requests. wt is the server
+// the request came in on; it is needed to upgrade the request.
+func ServeWebTransport(hub *Hub, wt *webtransport.Server, w http.ResponseWriter, r *http.Request) {
+	ip := hub.proxies.clientIP(r)
+	log.Debug().Str("ip", ip).Msg("servewt-new-conn")
+	path, connID, err := connParams(r)
+	if err != nil {
+		log.Error().Msg(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client := &Client{
+		hub:          hub,
+		transport:    transportWebTransport,
+		protocol:     protocolV1,
+		capabilities: CapBatching,
+		send:         make(chan outboundFrame, 256),
+		connToken:    hub.requestToken(r),
+		ip:           ip,
+		connectedAt:  time.Now(),
+	}
+
+	if aerr := hub.admit(r.Context(), client, connID); aerr != nil {
+		http.Error(w, aerr.Error(), aerr.status)
+		return
+	}
+	// Once the pumps are running, the hub releases the client when it goes.
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			hub.limiter.release(client)
+		}
+	}()
+
+	sess, err := wt.Upgrade(w, r)
+	if err != nil {
+		log.Err(err).Msg("upgrading webtransport session")
+		return
+	}
+	client.wtSession = sess
+
+	ctx, cancel := context.WithTimeout(sess.Context(), wtStreamAcceptWait)
+	client.wtStream, err = sess.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		log.Err(err).Msg("wt-accept-stream")
+		sess.CloseWithError(wtCodeNoStream, "no message stream opened")
+		return
+	}
+
+	handedOff = true
+	go client.wtWritePump()
+	go client.wtReadPump()
+	go client.wtLagPump()
+	go hub.registerAsync(context.WithoutCancel(r.Context()), client, path)
+	log.Debug().Str("connID", client.connID).Msg("leaving-servewt")
+}
+
+// wtReadPump reads frames off the message stream and hands them to the hub.
+// It is the WebTransport counterpart of readPump.
+func (c *Client) wtReadPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.wtSession.CloseWithError(wtCodeNormal, "")
+	}()
+	header := make([]byte, frameHeaderLen)
+	for {
+		if _, err := io.ReadFull(c.wtStream, header); err != nil {
+			log.Debug().Str("username", c.username).Err(err).Msg("wt-read-breaking-out")
+			return
+		}
+		n := int(binary.BigEndian.Uint16(header))
+		if n < 1 || n+frameHeaderLen > maxMessageSize {
+			log.Error().Str("username", c.username).Int("len", n).Msg("wt-bad-frame-length")
+			c.wtSession.CloseWithError(wtCodeBadFrame, "bad frame length")
+			return
+		}
+		message := make([]byte, frameHeaderLen+n)
+		copy(message, header)
+		if _, err := io.ReadFull(c.wtStream, message[frameHeaderLen:]); err != nil {
+			log.Debug().Str("username", c.username).Err(err).Msg("wt-read-breaking-out")
+			return
+		}
+
+		err := c.hub.parseAndExecuteMessage(context.Background(), message, c)
+		if err != nil {
+			log.Err(err).Str("username", c.username).Msg("parse-and-execute-message")
+			c.sendError(err)
+		}
+	}
+}
+
+// wtWritePump writes frames from the hub to the message stream. It is the
+// only writer to the stream.
+func (c *Client) wtWritePump() {
+	for {
+		frame, ok := <-c.send
+		if !ok {
+			// The hub closed the channel.
+			if c.closeCode != 0 {
+				c.wtSession.CloseWithError(webtransport.SessionErrorCode(c.closeCode), c.closeReason)
+			} else {
+				c.wtSession.CloseWithError(wtCodeHubClosed, "hub closed channel")
+			}
+			return
+		}
+		if frame.control {
+			// WebTransport clients don't negotiate control messages.
+			continue
+		}
+		c.wtStream.SetWriteDeadline(time.Now().Add(writeWait))
+		if _, err := c.wtStream.Write(frame.data); err != nil {
+			c.wtSession.CloseWithError(wtCodeNormal, "")
+			return
+		}
+	}
+}
+
+// wtLagPump sends lag probes over datagrams and records the echoes.
+func (c *Client) wtLagPump() {
+	ctx := c.wtSession.Context()
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		probe := make([]byte, lagProbeLen)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				now := time.Now()
+				binary.BigEndian.PutUint64(probe, uint64(now.UnixNano()))
+				c.Lock()
+				c.pingSent(now)
+				c.Unlock()
+				// Datagrams are best effort; a lost probe just means one
+				// less measurement.
+				c.wtSession.SendDatagram(probe)
+			}
+		}
+	}()
+
+	for {
+		echo, err := c.wtSession.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		if len(echo) != lagProbeLen {
+			continue
+		}
+		c.RLock()
+		sent := c.lastPingSent
+		c.RUnlock()
+		// Only the most recent probe counts; this also stops a client from
+		// making up its own lag.
+		if int64(binary.BigEndian.Uint64(echo)) != sent.UnixNano() {
+			continue
+		}
+		c.recordLag(received.Sub(sent))
+	}
+}
@@ -0,0 +1,147 @@
+// Package redact keeps credentials and personal data out of the logs, so
+// that they can be shipped to a third party.
+//
+// zerolog hooks can add fields to an event but can't change the ones that
+// are already there, so the scrubbing happens in a Writer that sits between
+// zerolog and the real output, and sees each event as a line of JSON.
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+const mask = "[redacted]"
+
+// credentials match secrets wherever they turn up in a log line: JWTs,
+// bearer tokens, token query parameters, auth subprotocols, NATS seeds and
+// the user info in URLs.
+var credentials = []struct {
+	re   *regexp.Regexp
+	repl []byte
+}{
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), []byte(mask)},
+	{regexp.MustCompile(`(?i)bearer [A-Za-z0-9._~+/=-]+`), []byte("Bearer " + mask)},
+	{regexp.MustCompile(`([?&]token=)[^&\s"]+`), []byte("${1}" + mask)},
+	{regexp.MustCompile(`liwords\.auth\.[^\s,"]+`), []byte("liwords.auth." + mask)},
+	{regexp.MustCompile(`S[UOANCAX][A-Z2-7]{56}`), []byte(mask)},
+	{regexp.MustCompile(`://[^/\s@"]+@`), []byte("://" + mask + "@")},
+}
+
+// PII policies.
+const (
+	// PIIKeep logs personal data as is.
+	PIIKeep = "keep"
+	// PIIHash logs a keyed hash of personal data in its place. The same
+	// value always gets the same hash, so you can still follow one user or
+	// address through the logs.
+	PIIHash = "hash"
+	// PIIDrop leaves personal data out altogether.
+	PIIDrop = "drop"
+)
+
+// piiFields are the log fields that hold personal data.
+var piiFields = []string{"username", "client", "ip", "ips"}
+
+// A Writer scrubs log lines before writing them to the underlying writer.
+type Writer struct {
+	w      io.Writer
+	policy string
+	key    []byte
+}
+
+// NewWriter returns a Writer with the given PII policy. key is used to hash
+// personal data; if it is empty a random key is used, so the hashes only
+// line up within one run of the server.
+func NewWriter(w io.Writer, policy string, key string) (*Writer, error) {
+	switch policy {
+	case PIIKeep, PIIHash, PIIDrop:
+	default:
+		return nil, fmt.Errorf("unknown PII policy %q", policy)
+	}
+	rw := &Writer{w: w, policy: policy, key: []byte(key)}
+	if policy == PIIHash && len(rw.key) == 0 {
+		rw.key = make([]byte, 32)
+		if _, err := rand.Read(rw.key); err != nil {
+			return nil, err
+		}
+	}
+	return rw, nil
+}
+
+// Write scrubs a single log line. It always reports that all of p was
+// written, since the scrubbed line may be shorter or longer.
+func (rw *Writer) Write(p []byte) (int, error) {
+	line := p
+	if rw.policy != PIIKeep {
+		line = rw.scrubPII(line)
+	}
+	for _, c := range credentials {
+		line = c.re.ReplaceAll(line, c.repl)
+	}
+	if _, err := rw.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (rw *Writer) scrubPII(line []byte) []byte {
+	// Most lines have no personal data; don't bother decoding those.
+	found := false
+	for _, f := range piiFields {
+		if bytes.Contains(line, []byte(`"`+f+`":`)) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return line
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		// Not JSON, e.g. the console writer; leave it be.
+		return line
+	}
+	for _, f := range piiFields {
+		v, ok := fields[f]
+		if !ok {
+			continue
+		}
+		if rw.policy == PIIDrop {
+			delete(fields, f)
+			continue
+		}
+		var str string
+		var list []string
+		if json.Unmarshal(v, &str) == nil {
+			fields[f], _ = json.Marshal(rw.hash([]byte(str)))
+			continue
+		}
+		if json.Unmarshal(v, &list) == nil {
+			for i := range list {
+				list[i] = rw.hash([]byte(list[i]))
+			}
+			fields[f], _ = json.Marshal(list)
+			continue
+		}
+		fields[f], _ = json.Marshal(rw.hash(v))
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return line
+	}
+	return append(out, '\n')
+}
+
+func (rw *Writer) hash(v []byte) string {
+	mac := hmac.New(sha256.New, rw.key)
+	mac.Write(v)
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
@@ -0,0 +1,126 @@
+// Package tracing sets up OpenTelemetry tracing, and carries trace context
+// across NATS so that the liwords backend can continue our traces.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	nats "github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+
+	"github.com/woogles-io/liwords-socket/pkg/config"
+)
+
+const serviceName = "liwords-socket"
+
+// Exporters that can be configured.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+	ExporterOTLP   = "otlp"
+)
+
+// Setup installs the global tracer provider and propagator. The returned
+// function flushes any pending spans and shuts the provider down; call it on
+// exit.
+func Setup(cfg *config.Config, version string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	var file *os.File
+	switch cfg.OTelExporter {
+	case ExporterNone, "":
+		// The global provider is a no-op until we set one.
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case ExporterFile:
+		file, err = os.OpenFile(cfg.OTelFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if cfg.OTelEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.OTelEndpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("unknown otel exporter %q", cfg.OTelExporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.OTelSampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// HeaderCarrier adapts NATS message headers for trace context propagation.
+// Unlike propagation.HeaderCarrier it leaves header names as they are, since
+// NATS headers are not canonicalized.
+type HeaderCarrier nats.Header
+
+func (hc HeaderCarrier) Get(key string) string {
+	return nats.Header(hc).Get(key)
+}
+
+func (hc HeaderCarrier) Set(key, value string) {
+	nats.Header(hc).Set(key, value)
+}
+
+func (hc HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(hc))
+	for k := range hc {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Inject writes the trace context from ctx into the message headers.
+func Inject(ctx context.Context, msg *nats.Msg) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier(msg.Header))
+}
+
+// Extract returns ctx with any trace context found in the message headers.
+func Extract(ctx context.Context, msg *nats.Msg) context.Context {
+	if msg.Header == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, HeaderCarrier(msg.Header))
+}